@@ -0,0 +1,248 @@
+// Package clientip resolves the address of the client behind trusted reverse
+// proxies from the X-Forwarded-For, X-Real-IP and Forwarded (RFC 7239)
+// headers and the PROXY protocol. Headers and PROXY headers are only
+// believed when they come from a configured proxy, so clients cannot spoof
+// their address to get around IP restrictions.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pires/go-proxyproto"
+)
+
+// Headers the client address can be taken from
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+	HeaderRealIP       = "X-Real-IP"
+	HeaderForwarded    = "Forwarded"
+)
+
+// connKey is the request context key of PROXY protocol connections
+type connKey struct{}
+
+// Resolver determines client addresses. The zero value trusts no proxies and
+// uses the address of the connection.
+type Resolver struct {
+	Proxies       []*net.IPNet // Proxies whose headers are trusted
+	Headers       []string     // Headers tried in order; the first one present is used
+	ProxyProtocol bool         // Accept PROXY protocol headers from trusted proxies
+	LogChain      bool         // Log how the address of every request was resolved
+}
+
+// NewFromEnv creates a resolver trusting the comma-separated addresses and
+// CIDRs in TRUSTED_PROXIES with the headers in TRUSTED_PROXY_HEADERS
+// (default X-Forwarded-For). PROXY_PROTOCOL=true accepts the PROXY protocol
+// from them and CLIENT_IP_LOG=true logs the resolved chain of every request.
+func NewFromEnv() (*Resolver, error) {
+	headers := os.Getenv("TRUSTED_PROXY_HEADERS")
+	if strings.TrimSpace(headers) == "" {
+		headers = HeaderForwardedFor
+	}
+
+	r, err := New(splitList(os.Getenv("TRUSTED_PROXIES")), splitList(headers))
+	if err != nil {
+		return nil, err
+	}
+	r.ProxyProtocol = os.Getenv("PROXY_PROTOCOL") == "true"
+	r.LogChain = os.Getenv("CLIENT_IP_LOG") == "true"
+	if r.ProxyProtocol && len(r.Proxies) == 0 {
+		return nil, fmt.Errorf("clientip: PROXY_PROTOCOL requires TRUSTED_PROXIES")
+	}
+	return r, nil
+}
+
+// New creates a resolver trusting the given proxy addresses and CIDRs with
+// the given headers
+func New(proxies, headers []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("clientip: invalid trusted proxy %q", proxy)
+			}
+			r.Proxies = append(r.Proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("clientip: invalid trusted proxy %q", proxy)
+		}
+		r.Proxies = append(r.Proxies, network)
+	}
+
+	for _, header := range headers {
+		switch canonical := http.CanonicalHeaderKey(header); canonical {
+		case HeaderForwardedFor, http.CanonicalHeaderKey(HeaderRealIP), HeaderForwarded:
+			r.Headers = append(r.Headers, canonical)
+		default:
+			return nil, fmt.Errorf("clientip: unsupported header %q, expected %s, %s or %s", header, HeaderForwardedFor, HeaderRealIP, HeaderForwarded)
+		}
+	}
+	return r, nil
+}
+
+// Trusts reports whether ip belongs to a trusted proxy
+func (r *Resolver) Trusts(ip net.IP) bool {
+	ip = Normalize(ip)
+	for _, network := range r.Proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of a request and the chain it was
+// resolved from: the addresses in the header used, followed by the peer.
+// Starting at the peer, the chain is walked back as long as the hops are
+// trusted proxies; the first untrusted or last valid hop is the client.
+func (r *Resolver) Resolve(req *http.Request) (net.IP, []string) {
+	peer := ParseIP(req.RemoteAddr)
+	chain := []string{req.RemoteAddr}
+	if peer == nil || !r.Trusts(peer) {
+		return peer, chain
+	}
+
+	for _, header := range r.Headers {
+		hops := headerHops(req.Header, header)
+		if len(hops) == 0 {
+			continue
+		}
+
+		client := peer
+		for i := len(hops) - 1; i >= 0 && r.Trusts(client); i-- {
+			ip := ParseIP(hops[i])
+			if ip == nil {
+				break
+			}
+			client = ip
+		}
+		return client, append(hops, req.RemoteAddr)
+	}
+	return peer, chain
+}
+
+// headerHops returns the addresses listed in a header, the client first
+func headerHops(h http.Header, header string) []string {
+	var hops []string
+	for _, value := range h.Values(header) {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if header == HeaderForwarded {
+				element = forwardedFor(element)
+			}
+			if element != "" {
+				hops = append(hops, element)
+			}
+		}
+	}
+	if header == http.CanonicalHeaderKey(HeaderRealIP) && len(hops) > 1 {
+		return hops[len(hops)-1:]
+	}
+	return hops
+}
+
+// forwardedFor returns the for= parameter of a Forwarded header element,
+// such as `for="[2001:db8::17]:4711";proto=https`. Obfuscated identifiers
+// and "unknown" are returned as is and do not parse as an address.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return "unknown"
+}
+
+// ParseIP parses an address with or without a port, such as "192.0.2.1",
+// "192.0.2.1:80" or "[2001:db8::1]:80", unmapping IPv4-mapped IPv6 addresses.
+// It returns nil if s is not an address.
+func ParseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	return Normalize(net.ParseIP(s))
+}
+
+// Normalize returns IPv4 and IPv4-mapped IPv6 addresses such as
+// ::ffff:192.0.2.1 in their 4-byte form, so that they compare equal
+func Normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Middleware replaces the remote address of every request with the resolved
+// client address, so that c.ClientIP() and everything else relying on it use
+// it. The router must not trust any proxies itself.
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip, chain := r.Resolve(c.Request)
+		if conn, ok := c.Request.Context().Value(connKey{}).(*proxyproto.Conn); ok && conn.ProxyHeader() != nil {
+			chain = append(chain, conn.Raw().RemoteAddr().String()+" (PROXY protocol)")
+		}
+		if r.LogChain {
+			log.Printf("Client IP %s resolved from %s", ip, strings.Join(chain, ", "))
+		}
+
+		if ip != nil {
+			_, port, err := net.SplitHostPort(c.Request.RemoteAddr)
+			if err != nil {
+				port = "0"
+			}
+			c.Request.RemoteAddr = net.JoinHostPort(ip.String(), port)
+		}
+		c.Next()
+	}
+}
+
+// Listen listens on a TCP address, accepting the PROXY protocol from trusted
+// proxies if enabled. Connections from other addresses are used as they are.
+func (r *Resolver) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || !r.ProxyProtocol {
+		return listener, err
+	}
+
+	return &proxyproto.Listener{
+		Listener: listener,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			if r.Trusts(ParseIP(upstream.String())) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.SKIP, nil
+		},
+	}, nil
+}
+
+// ConnContext makes PROXY protocol connections available to the middleware,
+// so that the proxy they came through is logged. Use it as http.Server.ConnContext.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return context.WithValue(ctx, connKey{}, pc)
+	}
+	return ctx
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,25 +2,30 @@ package controllers
 
 import (
 	"crypto/md5"
+	"defdrive/geoip"
+	"defdrive/ipfilter"
 	"defdrive/models"
 	"encoding/hex"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type AccessController struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	Geo *geoip.Resolver // nil without GeoIP databases
 }
 
 // NewAccessController creates a new access controller
-func NewAccessController(db *gorm.DB) *AccessController {
-	return &AccessController{DB: db}
+func NewAccessController(db *gorm.DB, geo *geoip.Resolver) *AccessController {
+	return &AccessController{DB: db, Geo: geo}
 }
 
 // generateRandomLink generates a random link that looks like an MD5 hash
@@ -38,6 +43,185 @@ func (ac *AccessController) generateRandomLink() string {
 	}
 }
 
+// checkPinnedVersion verifies that a version an access should be pinned to exists
+func (ac *AccessController) checkPinnedVersion(c *gin.Context, fileID uint, version int) bool {
+	if version == 0 {
+		return true
+	}
+	if version < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version number"})
+		return false
+	}
+
+	var count int64
+	if err := ac.DB.Model(&models.FileVersion{}).Where("file_id = ? AND version = ?", fileID, version).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file version"})
+		return false
+	}
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File version not found"})
+		return false
+	}
+	return true
+}
+
+// hashAccessPassword hashes the password of an access link, returning "" for
+// no password. It writes the error response and returns false on failure.
+func hashAccessPassword(c *gin.Context, password string) (string, bool) {
+	if password == "" {
+		return "", true
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid password"})
+		return "", false
+	}
+	return string(hash), true
+}
+
+// downloadLimit validates the requested download limit, mapping the deprecated
+// oneTimeUse and ttl fields onto it when maxDownloads is not given
+func downloadLimit(c *gin.Context, maxDownloads int, oneTimeUse, enableTTL bool, ttl int) (int, bool) {
+	if maxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxDownloads cannot be negative"})
+		return 0, false
+	}
+	if maxDownloads == 0 && oneTimeUse {
+		maxDownloads = 1
+	}
+	if maxDownloads == 0 && enableTTL {
+		// A ttl of n allowed n-1 downloads, as in the migration of existing links
+		if ttl <= 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be at least 2, as a ttl of 1 allows no downloads; use maxDownloads instead"})
+			return 0, false
+		}
+		maxDownloads = ttl - 1
+	}
+	return maxDownloads, true
+}
+
+// linkTime parses the expiry or activation time of an access, given either as
+// an RFC 3339 time or as a duration from now such as "72h". An empty value
+// means none. It writes the error response and returns false on failure.
+func linkTime(c *gin.Context, field, value string, now time.Time) (*time.Time, bool) {
+	if value == "" {
+		return nil, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": field + ` must be an RFC 3339 time such as "2025-12-31T23:59:59Z" or a duration such as "72h"`})
+		return nil, false
+	}
+	if d <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": field + " duration must be positive"})
+		return nil, false
+	}
+	t := now.Add(d)
+	return &t, true
+}
+
+// linkSchedule parses the expiry and activation times of an access request
+func linkSchedule(c *gin.Context, expires, notBefore string) (*time.Time, *time.Time, bool) {
+	now := time.Now()
+	expiresAt, ok := linkTime(c, "expires", expires, now)
+	if !ok {
+		return nil, nil, false
+	}
+	notBeforeAt, ok := linkTime(c, "notBefore", notBefore, now)
+	if !ok {
+		return nil, nil, false
+	}
+	if expiresAt != nil && notBeforeAt != nil && !notBeforeAt.Before(*expiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "notBefore must be before expires"})
+		return nil, nil, false
+	}
+	return expiresAt, notBeforeAt, true
+}
+
+// validSchedule checks the schedule of an access request, writing the error response on failure
+func validSchedule(c *gin.Context, schedule *models.Schedule) bool {
+	if schedule == nil {
+		return true
+	}
+	if err := schedule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// validAddressLists checks the address lists of an access request and
+// rewrites their entries in canonical form, writing the error response on failure
+func validAddressLists(c *gin.Context, subnets, ips, denySubnets, denyIPs *[]string) bool {
+	lists := []struct {
+		field   string
+		entries *[]string
+		parse   func(string) (ipfilter.Rule, error)
+	}{
+		{"subnets", subnets, ipfilter.ParseSubnet},
+		{"ips", ips, ipfilter.ParseAddress},
+		{"denySubnets", denySubnets, ipfilter.ParseSubnet},
+		{"denyIPs", denyIPs, ipfilter.ParseAddress},
+	}
+	for _, list := range lists {
+		if len(*list.entries) == 0 {
+			*list.entries = nil
+			continue
+		}
+		rules, err := ipfilter.ParseList(*list.entries, list.parse)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + list.field + " entry: " + err.Error()})
+			return false
+		}
+		*list.entries = rules.Strings()
+	}
+	return true
+}
+
+// geoRestriction is the part of access requests limiting the countries and
+// autonomous systems clients may connect from
+type geoRestriction struct {
+	AllowCountries []string `json:"allowCountries"` // ISO 3166-1 alpha-2 codes such as "DE"
+	DenyCountries  []string `json:"denyCountries"`
+	AllowASNs      []uint   `json:"allowASNs"`
+	DenyASNs       []uint   `json:"denyASNs"`
+}
+
+// validate normalizes the country codes and checks that the databases the
+// lists need are configured, writing the error response on failure
+func (r *geoRestriction) validate(c *gin.Context, geo *geoip.Resolver) bool {
+	for _, codes := range []*[]string{&r.AllowCountries, &r.DenyCountries} {
+		for i, code := range *codes {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid country code " + strconv.Quote(code) + ", expected ISO 3166-1 alpha-2 such as \"DE\""})
+				return false
+			}
+			(*codes)[i] = code
+		}
+	}
+	for _, asn := range append(append([]uint{}, r.AllowASNs...), r.DenyASNs...) {
+		if asn == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid autonomous system number 0"})
+			return false
+		}
+	}
+
+	if (len(r.AllowCountries) > 0 || len(r.DenyCountries) > 0) && !geo.HasCountries() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Country restrictions are not available on this server"})
+		return false
+	}
+	if (len(r.AllowASNs) > 0 || len(r.DenyASNs) > 0) && !geo.HasASNs() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Autonomous system restrictions are not available on this server"})
+		return false
+	}
+	return true
+}
+
 // CreateAccess generates a new access record for a file
 func (ac *AccessController) CreateAccess(c *gin.Context) {
 	userID, exists := c.Get("userID")
@@ -66,14 +250,27 @@ func (ac *AccessController) CreateAccess(c *gin.Context) {
 
 	// Parse request body
 	var accessRequest struct {
-		Name       string   `json:"name"`
-		Subnets    []string `json:"subnets"`
-		IPs        []string `json:"ips"`
-		Expires    string   `json:"expires"`
-		Public     bool     `json:"public"`
-		OneTimeUse bool     `json:"oneTimeUse"`
-		TTL        int      `json:"ttl"`
-		EnableTTL  bool     `json:"enableTTL"`
+		Name      string   `json:"name"`
+		Subnets   []string `json:"subnets"`
+		IPs       []string `json:"ips"`
+		Expires   string   `json:"expires"`   // RFC 3339 time or duration from now; empty never expires
+		NotBefore string   `json:"notBefore"` // RFC 3339 time or duration from now; empty is active immediately
+		Public    bool     `json:"public"`
+		Version   int      `json:"version"`  // 0 follows the current version
+		Password  string   `json:"password"` // Optional password recipients must enter
+		MaxBytes  int64    `json:"maxBytes"` // Data transfer budget; 0 is unlimited
+
+		Schedule *models.Schedule `json:"schedule"` // Recurring time windows; null is always
+
+		DenySubnets []string `json:"denySubnets"` // Blocked even if the other restrictions allow them
+		DenyIPs     []string `json:"denyIPs"`     // Addresses or ranges such as "10.0.0.1-10.0.0.99"
+
+		geoRestriction
+
+		MaxDownloads int  `json:"maxDownloads"` // Number of downloads allowed; 0 is unlimited
+		OneTimeUse   bool `json:"oneTimeUse"`   // Deprecated: same as maxDownloads 1
+		TTL          int  `json:"ttl"`          // Deprecated: with enableTTL, same as maxDownloads ttl-1
+		EnableTTL    bool `json:"enableTTL"`
 	}
 
 	if err := c.ShouldBindJSON(&accessRequest); err != nil {
@@ -81,21 +278,75 @@ func (ac *AccessController) CreateAccess(c *gin.Context) {
 		return
 	}
 
+	if !ac.checkPinnedVersion(c, file.ID, accessRequest.Version) {
+		return
+	}
+
+	if accessRequest.MaxBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxBytes cannot be negative"})
+		return
+	}
+
+	maxDownloads, ok := downloadLimit(c, accessRequest.MaxDownloads, accessRequest.OneTimeUse, accessRequest.EnableTTL, accessRequest.TTL)
+	if !ok {
+		return
+	}
+
+	expires, notBefore, ok := linkSchedule(c, accessRequest.Expires, accessRequest.NotBefore)
+	if !ok {
+		return
+	}
+	if expires != nil && !expires.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires must be in the future"})
+		return
+	}
+
+	if !validSchedule(c, accessRequest.Schedule) {
+		return
+	}
+
+	if !validAddressLists(c, &accessRequest.Subnets, &accessRequest.IPs, &accessRequest.DenySubnets, &accessRequest.DenyIPs) {
+		return
+	}
+
+	if !accessRequest.geoRestriction.validate(c, ac.Geo) {
+		return
+	}
+
+	passwordHash, ok := hashAccessPassword(c, accessRequest.Password)
+	if !ok {
+		return
+	}
+
 	// Generate a unique access link
 	link := ac.generateRandomLink()
 
 	// Create the access record
 	access := models.Access{
-		FileID:     uint(fileID),
-		Name:       accessRequest.Name,
-		Link:       link,
-		Subnets:    accessRequest.Subnets,
-		IPs:        accessRequest.IPs,
-		Expires:    accessRequest.Expires,
-		Public:     accessRequest.Public,
-		OneTimeUse: accessRequest.OneTimeUse,
-		TTL:        accessRequest.TTL,
-		EnableTTL:  accessRequest.EnableTTL,
+		FileID:    uint(fileID),
+		Name:      accessRequest.Name,
+		Link:      link,
+		Subnets:   accessRequest.Subnets,
+		IPs:       accessRequest.IPs,
+		Expires:   expires,
+		NotBefore: notBefore,
+		Schedule:  accessRequest.Schedule,
+		Public:    accessRequest.Public,
+		Version:   accessRequest.Version,
+		MaxBytes:  accessRequest.MaxBytes,
+
+		MaxDownloads: maxDownloads,
+
+		DenySubnets: accessRequest.DenySubnets,
+		DenyIPs:     accessRequest.DenyIPs,
+
+		AllowCountries: accessRequest.AllowCountries,
+		DenyCountries:  accessRequest.DenyCountries,
+		AllowASNs:      accessRequest.AllowASNs,
+		DenyASNs:       accessRequest.DenyASNs,
+
+		PasswordHash:      passwordHash,
+		PasswordProtected: passwordHash != "",
 	}
 
 	if result := ac.DB.Create(&access); result.Error != nil {
@@ -181,7 +432,34 @@ func (ac *AccessController) GetAccess(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"access": access})
+	c.JSON(http.StatusOK, gin.H{
+		"access":         access,
+		"bytes_used":     access.BytesUsed,
+		"bytes_left":     bytesLeft(access),
+		"downloads_left": downloadsLeft(access),
+	})
+}
+
+// bytesLeft returns the remaining data transfer budget of an access, or nil if it is unlimited
+func bytesLeft(access models.Access) interface{} {
+	if access.MaxBytes == 0 {
+		return nil
+	}
+	if access.BytesUsed >= access.MaxBytes {
+		return int64(0)
+	}
+	return access.MaxBytes - access.BytesUsed
+}
+
+// downloadsLeft returns the number of downloads an access still allows, or nil if it is unlimited
+func downloadsLeft(access models.Access) interface{} {
+	if access.MaxDownloads == 0 {
+		return nil
+	}
+	if access.DownloadCount >= access.MaxDownloads {
+		return 0
+	}
+	return access.MaxDownloads - access.DownloadCount
 }
 
 // UpdateAccess modifies an existing access record
@@ -222,11 +500,26 @@ func (ac *AccessController) UpdateAccess(c *gin.Context) {
 		Name       string   `json:"name"`
 		Subnets    []string `json:"subnets"`
 		IPs        []string `json:"ips"`
-		Expires    string   `json:"expires"`
+		Expires    string   `json:"expires"`   // RFC 3339 time or duration from now; empty never expires
+		NotBefore  string   `json:"notBefore"` // RFC 3339 time or duration from now; empty is active immediately
 		Public     bool     `json:"public"`
-		OneTimeUse bool     `json:"oneTimeUse"`
-		TTL        int      `json:"ttl"`
-		EnableTTL  bool     `json:"enableTTL"`
+		Version    int      `json:"version"`  // 0 follows the current version
+		Password   *string  `json:"password"` // Omit to keep the password, "" to remove it
+		MaxBytes   int64    `json:"maxBytes"` // Data transfer budget; 0 is unlimited
+		ResetBytes bool     `json:"resetBytesUsed"`
+
+		Schedule *models.Schedule `json:"schedule"` // Recurring time windows; null is always
+
+		DenySubnets []string `json:"denySubnets"` // Blocked even if the other restrictions allow them
+		DenyIPs     []string `json:"denyIPs"`     // Addresses or ranges such as "10.0.0.1-10.0.0.99"
+
+		geoRestriction
+
+		MaxDownloads       int  `json:"maxDownloads"` // Number of downloads allowed; 0 is unlimited
+		ResetDownloadCount bool `json:"resetDownloadCount"`
+		OneTimeUse         bool `json:"oneTimeUse"` // Deprecated: same as maxDownloads 1
+		TTL                int  `json:"ttl"`        // Deprecated: with enableTTL, same as maxDownloads ttl-1
+		EnableTTL          bool `json:"enableTTL"`
 	}
 
 	if err := c.ShouldBindJSON(&updateRequest); err != nil {
@@ -234,20 +527,83 @@ func (ac *AccessController) UpdateAccess(c *gin.Context) {
 		return
 	}
 
+	if !ac.checkPinnedVersion(c, file.ID, updateRequest.Version) {
+		return
+	}
+
+	if updateRequest.MaxBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "maxBytes cannot be negative"})
+		return
+	}
+
+	maxDownloads, ok := downloadLimit(c, updateRequest.MaxDownloads, updateRequest.OneTimeUse, updateRequest.EnableTTL, updateRequest.TTL)
+	if !ok {
+		return
+	}
+
+	expires, notBefore, ok := linkSchedule(c, updateRequest.Expires, updateRequest.NotBefore)
+	if !ok {
+		return
+	}
+
+	if !validSchedule(c, updateRequest.Schedule) {
+		return
+	}
+
+	if !validAddressLists(c, &updateRequest.Subnets, &updateRequest.IPs, &updateRequest.DenySubnets, &updateRequest.DenyIPs) {
+		return
+	}
+
+	if !updateRequest.geoRestriction.validate(c, ac.Geo) {
+		return
+	}
+
+	if updateRequest.Password != nil {
+		passwordHash, ok := hashAccessPassword(c, *updateRequest.Password)
+		if !ok {
+			return
+		}
+		access.PasswordHash = passwordHash
+		access.PasswordProtected = passwordHash != ""
+	}
+
 	// Update the access record
 	access.Name = updateRequest.Name
 	access.Subnets = updateRequest.Subnets
 	access.IPs = updateRequest.IPs
-	access.Expires = updateRequest.Expires
+	access.Expires = expires
+	access.NotBefore = notBefore
+	access.Schedule = updateRequest.Schedule
 	access.Public = updateRequest.Public
-	access.OneTimeUse = updateRequest.OneTimeUse
-	access.TTL = updateRequest.TTL
-	access.EnableTTL = updateRequest.EnableTTL
-
-	if err := ac.DB.Save(&access).Error; err != nil {
+	access.Version = updateRequest.Version
+	access.MaxBytes = updateRequest.MaxBytes
+	access.MaxDownloads = maxDownloads
+	access.DenySubnets = updateRequest.DenySubnets
+	access.DenyIPs = updateRequest.DenyIPs
+	access.AllowCountries = updateRequest.AllowCountries
+	access.DenyCountries = updateRequest.DenyCountries
+	access.AllowASNs = updateRequest.AllowASNs
+	access.DenyASNs = updateRequest.DenyASNs
+
+	// The counters are only changed by downloads (or an explicit reset), never overwritten with a stale value
+	if err := ac.DB.Omit("BytesUsed", "DownloadCount").Save(&access).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update access record"})
 		return
 	}
+	if updateRequest.ResetBytes {
+		if err := ac.DB.Model(&access).UpdateColumn("bytes_used", 0).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset data transfer count"})
+			return
+		}
+		access.BytesUsed = 0
+	}
+	if updateRequest.ResetDownloadCount {
+		if err := ac.DB.Model(&access).UpdateColumn("download_count", 0).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset download count"})
+			return
+		}
+		access.DownloadCount = 0
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Access updated successfully",
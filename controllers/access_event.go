@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Access log pagination defaults
+const (
+	defaultEventsPerPage = 50
+	maxEventsPerPage     = 500
+	eventExportBatchSize = 1000
+)
+
+// ListAccessEvents returns the access log of an access link, newest first.
+// It supports ?page=&per_page= pagination, ?outcome=, ?since= and ?until=
+// (RFC 3339) filters, and ?format=csv to export every matching event.
+func (ac *AccessController) ListAccessEvents(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	accessID, err := strconv.ParseUint(c.Param("accessID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid access ID"})
+		return
+	}
+
+	// Find the access record and associated file
+	var access models.Access
+	if err := ac.DB.First(&access, uint(accessID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access not found"})
+		return
+	}
+
+	var file models.File
+	if err := ac.DB.First(&file, access.FileID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Check if the user owns the file
+	if file.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this access"})
+		return
+	}
+
+	query, ok := accessEventQuery(c, ac.DB, access.ID)
+	if !ok {
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		exportAccessEvents(c, query, access.ID)
+		return
+	}
+
+	page, perPage, ok := pagination(c)
+	if !ok {
+		return
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Model(&models.AccessEvent{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve access events"})
+		return
+	}
+
+	var events []models.AccessEvent
+	if err := query.Order("created_at DESC, id DESC").Offset((page - 1) * perPage).Limit(perPage).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve access events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":   events,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
+
+// accessEventQuery builds the query for an access's events from the request's filters
+func accessEventQuery(c *gin.Context, db *gorm.DB, accessID uint) (*gorm.DB, bool) {
+	query := db.Where("access_id = ?", accessID)
+
+	if outcome := c.Query("outcome"); outcome != "" {
+		if outcome != models.EventAllowed && outcome != models.EventDenied && outcome != models.EventError {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid outcome"})
+			return nil, false
+		}
+		query = query.Where("outcome = ?", outcome)
+	}
+
+	for param, condition := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s time, expected RFC 3339", param)})
+			return nil, false
+		}
+		query = query.Where(condition, t)
+	}
+
+	return query, true
+}
+
+// pagination reads the page and per_page query parameters
+func pagination(c *gin.Context) (int, int, bool) {
+	page, perPage := 1, defaultEventsPerPage
+	if value := c.Query("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+			return 0, 0, false
+		}
+		page = n
+	}
+	if value := c.Query("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxEventsPerPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("per_page must be between 1 and %d", maxEventsPerPage)})
+			return 0, 0, false
+		}
+		perPage = n
+	}
+	return page, perPage, true
+}
+
+// exportAccessEvents streams every event matched by query as a CSV attachment,
+// oldest first. The response starts with the first batch, so that a failing
+// query can still be answered with 500; later failures end the download early.
+func exportAccessEvents(c *gin.Context, query *gorm.DB, accessID uint) {
+	w := csv.NewWriter(c.Writer)
+	started := false
+	start := func() {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="access-%d-events.csv"`, accessID))
+		c.Status(http.StatusOK)
+		w.Write([]string{"time", "client_ip", "method", "status", "outcome", "reason", "download", "bytes_served", "duration_ms", "user_agent", "referer"})
+		started = true
+	}
+
+	var events []models.AccessEvent
+	err := query.FindInBatches(&events, eventExportBatchSize, func(tx *gorm.DB, batch int) error {
+		if !started {
+			start()
+		}
+		for _, event := range events {
+			w.Write([]string{
+				event.CreatedAt.UTC().Format(time.RFC3339),
+				event.ClientIP,
+				event.Method,
+				strconv.Itoa(event.Status),
+				event.Outcome,
+				event.Reason,
+				strconv.FormatBool(event.Download),
+				strconv.FormatInt(event.BytesServed, 10),
+				strconv.FormatInt(event.DurationMS, 10),
+				csvSafe(event.UserAgent),
+				csvSafe(event.Referer),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}).Error
+	if err != nil {
+		log.Printf("Failed to export access events of access %d: %v", accessID, err)
+		if !started {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export access events"})
+		}
+		return
+	}
+
+	// No events: just the header row
+	if !started {
+		start()
+	}
+	w.Flush()
+}
+
+// csvSafe keeps client-supplied values from being interpreted as spreadsheet formulas
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"context"
+	"defdrive/mailer"
+	"defdrive/models"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Lifetimes of emailed tokens
+const (
+	passwordResetTTL = time.Hour
+	verifyEmailTTL   = 48 * time.Hour
+	mailSendTimeout  = 30 * time.Second
+)
+
+type AccountController struct {
+	DB     *gorm.DB
+	Mailer mailer.Mailer
+}
+
+// NewAccountController creates a new account recovery and verification controller
+func NewAccountController(db *gorm.DB, mail mailer.Mailer) *AccountController {
+	return &AccountController{DB: db, Mailer: mail}
+}
+
+// requireEmailVerification reports whether login is blocked until the email is verified (REQUIRE_EMAIL_VERIFICATION)
+func requireEmailVerification() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// publicURL returns an absolute URL for path on this server (HOST_URL)
+func publicURL(path string) string {
+	host := strings.TrimRight(os.Getenv("HOST_URL"), "/")
+	if host == "" {
+		host = "http://localhost:8080"
+	}
+	return host + path
+}
+
+// issueEmailToken records a single-use token for user and returns it signed
+func issueEmailToken(db *gorm.DB, user models.User, purpose string, ttl time.Duration) (string, error) {
+	record := models.EmailToken{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"jti":    record.ID,
+		"userID": user.ID,
+		"typ":    purpose,
+		"exp":    record.ExpiresAt.Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+// consumeEmailToken validates a token for purpose and marks it used, so that
+// it cannot be used again
+func consumeEmailToken(db *gorm.DB, tokenString, purpose string) (models.EmailToken, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.NewValidationError("unexpected signing method", jwt.ValidationErrorSignatureInvalid)
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid {
+		return models.EmailToken{}, errors.New("invalid or expired token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	id, hasID := claims["jti"].(string)
+	if !ok || !hasID || claims["typ"] != purpose {
+		return models.EmailToken{}, errors.New("invalid token")
+	}
+
+	now := time.Now()
+	result := db.Model(&models.EmailToken{}).
+		Where("id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", id, purpose, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return models.EmailToken{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return models.EmailToken{}, errors.New("token already used or expired")
+	}
+
+	var record models.EmailToken
+	if err := db.First(&record, "id = ?", id).Error; err != nil {
+		return models.EmailToken{}, err
+	}
+	return record, nil
+}
+
+// sendMail delivers msg in the background, so that response times do not
+// reveal whether an address belongs to an account
+func sendMail(m mailer.Mailer, msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+		defer cancel()
+		if err := m.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send email to %s: %v", msg.To, err)
+		}
+	}()
+}
+
+// sendVerificationEmail emails user a link that confirms their address
+func sendVerificationEmail(db *gorm.DB, m mailer.Mailer, user models.User) error {
+	token, err := issueEmailToken(db, user, models.TokenPurposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	sendMail(m, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your DefDrive email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm your email address by opening this link within %s:\n\n%s\n\nIf you did not create an account, ignore this email.\n",
+			user.Username, verifyEmailTTL, publicURL("/api/email/verify?token="+url.QueryEscape(token))),
+	})
+	return nil
+}
+
+// ForgotPassword emails a password reset token to the accounts registered with
+// an address. The response is the same whether or not such an account exists.
+func (ac *AccountController) ForgotPassword(c *gin.Context) {
+	var requestBody struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var users []models.User
+	if err := ac.DB.Where("LOWER(email) = LOWER(?)", strings.TrimSpace(requestBody.Email)).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up account"})
+		return
+	}
+
+	for _, user := range users {
+		token, err := issueEmailToken(ac.DB, user, models.TokenPurposePasswordReset, passwordResetTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+			return
+		}
+
+		sendMail(ac.Mailer, mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your DefDrive password",
+			Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. To choose a new password, send this token with it to %s within %s:\n\n%s\n\nIf this was not you, ignore this email; your password has not been changed.\n",
+				user.Username, publicURL("/api/password/reset"), passwordResetTTL, token),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an account with this email exists, a password reset email has been sent"})
+}
+
+// ResetPassword sets a new password using an emailed token, logs out every
+// session and revokes every personal access token
+func (ac *AccountController) ResetPassword(c *gin.Context) {
+	var requestBody struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A token and a password of at least 8 characters are required"})
+		return
+	}
+
+	record, err := consumeEmailToken(ac.DB, requestBody.Token, models.TokenPurposePasswordReset)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid, expired or already used token"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(requestBody.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	now := time.Now()
+	err = ac.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"password": string(hashedPassword)}
+		// Receiving the email proves the address, as long as it has not changed since
+		var user models.User
+		if err := tx.First(&user, record.UserID).Error; err != nil {
+			return err
+		}
+		if user.EmailVerifiedAt == nil && user.Email == record.Email {
+			updates["email_verified_at"] = now
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// Other reset tokens, existing sessions and personal access tokens may be in the wrong hands
+		if err := tx.Model(&models.EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", record.UserID, models.TokenPurposePasswordReset).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.PersonalAccessToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", record.UserID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", record.UserID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully. Please log in again and create new personal access tokens."})
+}
+
+// VerifyEmail confirms a user's email address with an emailed token, given
+// as the "token" query parameter (the emailed link) or in a JSON body
+func (ac *AccountController) VerifyEmail(c *gin.Context) {
+	tokenString := c.Query("token")
+	if tokenString == "" {
+		var requestBody struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+			return
+		}
+		tokenString = requestBody.Token
+	}
+
+	record, err := consumeEmailToken(ac.DB, tokenString, models.TokenPurposeVerifyEmail)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid, expired or already used token"})
+		return
+	}
+
+	// The token only verifies the address it was sent to
+	result := ac.DB.Model(&models.User{}).
+		Where("id = ? AND email = ?", record.UserID, record.Email).
+		Update("email_verified_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The email address has changed since this token was sent"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerification emails a new verification link to unverified accounts
+// registered with an address. The response does not reveal whether one exists.
+func (ac *AccountController) ResendVerification(c *gin.Context) {
+	var requestBody struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var users []models.User
+	if err := ac.DB.Where("LOWER(email) = LOWER(?) AND email_verified_at IS NULL", strings.TrimSpace(requestBody.Email)).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up account"})
+		return
+	}
+
+	for _, user := range users {
+		if err := sendVerificationEmail(ac.DB, ac.Mailer, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create verification token"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If an unverified account with this email exists, a verification email has been sent"})
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Analytics defaults and limits
+const (
+	defaultAnalyticsRange = 30 * 24 * time.Hour
+	maxAnalyticsBuckets   = 1000
+	topSubnetCount        = 10
+)
+
+// analyticsIntervals maps the accepted ?interval= values to their bucket size
+var analyticsIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+type AnalyticsController struct {
+	DB *gorm.DB
+}
+
+// NewAnalyticsController creates a new link analytics controller
+func NewAnalyticsController(db *gorm.DB) *AnalyticsController {
+	return &AnalyticsController{DB: db}
+}
+
+// analyticsTotals sums up the requests of a time range
+type analyticsTotals struct {
+	Requests    int64 `json:"requests"`
+	Downloads   int64 `json:"downloads"`
+	Denied      int64 `json:"denied"`
+	Errors      int64 `json:"errors"`
+	UniqueIPs   int64 `json:"unique_ips"`
+	BytesServed int64 `json:"bytes_served"`
+}
+
+// analyticsBucket is one hour or day of the timeline
+type analyticsBucket struct {
+	Bucket      time.Time `json:"bucket"`
+	Requests    int64     `json:"requests"`
+	Downloads   int64     `json:"downloads"`
+	Denied      int64     `json:"denied"`
+	UniqueIPs   int64     `json:"unique_ips"`
+	BytesServed int64     `json:"bytes_served"`
+}
+
+type analyticsSubnet struct {
+	Subnet      string `json:"subnet"`
+	Requests    int64  `json:"requests"`
+	Downloads   int64  `json:"downloads"`
+	UniqueIPs   int64  `json:"unique_ips"`
+	BytesServed int64  `json:"bytes_served"`
+}
+
+type analyticsReason struct {
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+type analyticsAccess struct {
+	AccessID    uint  `json:"access_id"`
+	Requests    int64 `json:"requests"`
+	Downloads   int64 `json:"downloads"`
+	Denied      int64 `json:"denied"`
+	BytesServed int64 `json:"bytes_served"`
+}
+
+// AccessAnalytics returns aggregated usage statistics of an access link
+func (anc *AnalyticsController) AccessAnalytics(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	accessID, err := strconv.ParseUint(c.Param("accessID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid access ID"})
+		return
+	}
+
+	var access models.Access
+	if err := anc.DB.First(&access, uint(accessID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access not found"})
+		return
+	}
+
+	var file models.File
+	if err := anc.DB.First(&file, access.FileID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	if file.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this access"})
+		return
+	}
+
+	stats, ok := anc.analytics(c, "access_id = ?", access.ID)
+	if !ok {
+		return
+	}
+	stats["access_id"] = access.ID
+	c.JSON(http.StatusOK, stats)
+}
+
+// FileAnalytics returns aggregated usage statistics of all access links of a
+// file, including deleted ones, with a breakdown per access
+func (anc *AnalyticsController) FileAnalytics(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	fileID, err := strconv.ParseUint(c.Param("fileID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	var file models.File
+	if err := anc.DB.First(&file, uint(fileID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	if file.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this file"})
+		return
+	}
+
+	scope := "access_id IN (SELECT id FROM accesses WHERE file_id = ?)"
+	stats, ok := anc.analytics(c, scope, file.ID)
+	if !ok {
+		return
+	}
+
+	var accesses []analyticsAccess
+	if err := anc.DB.Raw(`
+		SELECT
+			access_id,
+			COUNT(*) AS requests,
+			COUNT(*) FILTER (WHERE download) AS downloads,
+			COUNT(*) FILTER (WHERE outcome = ?) AS denied,
+			COALESCE(SUM(bytes_served), 0) AS bytes_served
+		FROM access_events
+		WHERE `+scope+` AND created_at >= ? AND created_at < ?
+		GROUP BY access_id
+		ORDER BY requests DESC
+	`, models.EventDenied, file.ID, stats["since"], stats["until"]).Scan(&accesses).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute analytics"})
+		return
+	}
+
+	stats["file_id"] = file.ID
+	stats["accesses"] = accesses
+	c.JSON(http.StatusOK, stats)
+}
+
+// analytics aggregates the access events matching scope (a condition with one
+// argument) over the time range and interval given in the query string.
+// All aggregation happens in Postgres.
+func (anc *AnalyticsController) analytics(c *gin.Context, scope string, arg interface{}) (gin.H, bool) {
+	interval := c.DefaultQuery("interval", "day")
+	step, ok := analyticsIntervals[interval]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be hour or day"})
+		return nil, false
+	}
+
+	until := time.Now().UTC()
+	since := until.Add(-defaultAnalyticsRange)
+	for param, target := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s time, expected RFC 3339", param)})
+				return nil, false
+			}
+			*target = t.UTC()
+		}
+	}
+	if !since.Before(until) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be before until"})
+		return nil, false
+	}
+	if until.Sub(since)/step > maxAnalyticsBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Time range too long for %s buckets (at most %d)", interval, maxAnalyticsBuckets)})
+		return nil, false
+	}
+
+	where := scope + " AND created_at >= ? AND created_at < ?"
+	args := []interface{}{arg, since, until}
+	fail := func() (gin.H, bool) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute analytics"})
+		return nil, false
+	}
+
+	var totals analyticsTotals
+	if err := anc.DB.Raw(`
+		SELECT
+			COUNT(*) AS requests,
+			COUNT(*) FILTER (WHERE download) AS downloads,
+			COUNT(*) FILTER (WHERE outcome = ?) AS denied,
+			COUNT(*) FILTER (WHERE outcome = ?) AS errors,
+			COUNT(DISTINCT client_ip) AS unique_ips,
+			COALESCE(SUM(bytes_served), 0) AS bytes_served
+		FROM access_events
+		WHERE `+where,
+		append([]interface{}{models.EventDenied, models.EventError}, args...)...).Scan(&totals).Error; err != nil {
+		return fail()
+	}
+
+	// Buckets are in UTC; generate_series fills in the hours or days without requests
+	timeline := []analyticsBucket{}
+	if err := anc.DB.Raw(`
+		WITH stats AS (
+			SELECT
+				date_trunc('`+interval+`', created_at AT TIME ZONE 'UTC') AS bucket,
+				COUNT(*) AS requests,
+				COUNT(*) FILTER (WHERE download) AS downloads,
+				COUNT(*) FILTER (WHERE outcome = ?) AS denied,
+				COUNT(DISTINCT client_ip) AS unique_ips,
+				COALESCE(SUM(bytes_served), 0) AS bytes_served
+			FROM access_events
+			WHERE `+where+`
+			GROUP BY 1
+		)
+		SELECT
+			b.bucket,
+			COALESCE(s.requests, 0) AS requests,
+			COALESCE(s.downloads, 0) AS downloads,
+			COALESCE(s.denied, 0) AS denied,
+			COALESCE(s.unique_ips, 0) AS unique_ips,
+			COALESCE(s.bytes_served, 0) AS bytes_served
+		FROM generate_series(
+			date_trunc('`+interval+`', ?::timestamptz AT TIME ZONE 'UTC'),
+			?::timestamptz AT TIME ZONE 'UTC' - interval '1 microsecond',
+			interval '1 `+interval+`'
+		) AS b(bucket)
+		LEFT JOIN stats s ON s.bucket = b.bucket
+		ORDER BY b.bucket
+	`, append(append([]interface{}{models.EventDenied}, args...), since, until)...).Scan(&timeline).Error; err != nil {
+		return fail()
+	}
+
+	// Clients are grouped by /24 for IPv4 and /64 for IPv6
+	topSubnets := []analyticsSubnet{}
+	if err := anc.DB.Raw(`
+		SELECT
+			network(set_masklen(client_ip::inet, CASE WHEN family(client_ip::inet) = 4 THEN 24 ELSE 64 END))::text AS subnet,
+			COUNT(*) AS requests,
+			COUNT(*) FILTER (WHERE download) AS downloads,
+			COUNT(DISTINCT client_ip) AS unique_ips,
+			COALESCE(SUM(bytes_served), 0) AS bytes_served
+		FROM access_events
+		WHERE `+where+` AND client_ip <> ''
+		GROUP BY 1
+		ORDER BY requests DESC, subnet
+		LIMIT ?
+	`, append(args, topSubnetCount)...).Scan(&topSubnets).Error; err != nil {
+		return fail()
+	}
+
+	denyReasons := []analyticsReason{}
+	if err := anc.DB.Raw(`
+		SELECT reason, COUNT(*) AS count
+		FROM access_events
+		WHERE `+where+` AND outcome = ?
+		GROUP BY reason
+		ORDER BY count DESC, reason
+	`, append(args, models.EventDenied)...).Scan(&denyReasons).Error; err != nil {
+		return fail()
+	}
+
+	return gin.H{
+		"interval":     interval,
+		"since":        since,
+		"until":        until,
+		"totals":       totals,
+		"timeline":     timeline,
+		"top_subnets":  topSubnets,
+		"deny_reasons": denyReasons,
+	}, true
+}
@@ -1,23 +1,31 @@
 package controllers
 
 import (
+	"context"
 	"defdrive/models"
+	"defdrive/storage"
+	"defdrive/webhook"
+	"io"
+	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type FileController struct {
-	DB *gorm.DB
+	DB    *gorm.DB
+	Blobs *storage.Blobs
+	Hooks *webhook.Dispatcher
 }
 
 // NewFileController creates a new file controller
-func NewFileController(db *gorm.DB) *FileController {
-	return &FileController{DB: db}
+func NewFileController(db *gorm.DB, blobs *storage.Blobs, hooks *webhook.Dispatcher) *FileController {
+	return &FileController{DB: db, Blobs: blobs, Hooks: hooks}
 }
 
 // Upload handles file uploads
@@ -43,80 +51,45 @@ func (fc *FileController) Upload(c *gin.Context) {
 		return
 	}
 
-	// Check current file count
-	var currentFileCount int64
-	if err := fc.DB.Model(&models.File{}).Where("user_id = ?", userID).Count(&currentFileCount).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check current file count"})
+	// Resolve the target folder (the root if none is given)
+	folderID, ok := parseFolderID(c, fc.DB, user.ID, c.PostForm("folder_id"))
+	if !ok {
 		return
 	}
 
-	// Check file limit
-	if currentFileCount >= int64(user.MaxFiles) {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error":         "File limit exceeded",
-			"current_files": currentFileCount,
-			"max_files":     user.MaxFiles,
-		})
+	// Uploading to an existing name creates a new version of that file
+	existing, ok := findExistingFile(c, fc.DB, user.ID, folderID, file.Filename)
+	if !ok {
 		return
 	}
 
-	// Check current storage usage
-	var currentStorage int64
-	if err := fc.DB.Model(&models.File{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&currentStorage).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check current storage usage"})
+	// Check file count and storage limits
+	if !checkUploadLimits(c, fc.DB, user, file.Size, existing == nil) {
 		return
 	}
 
-	// Check storage limit
-	if currentStorage+file.Size > user.MaxStorage {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error":           "Storage limit exceeded",
-			"current_storage": currentStorage,
-			"max_storage":     user.MaxStorage,
-			"file_size":       file.Size,
-		})
-		return
-	}
-
-	// Create user directory if it doesn't exist
-	userDir := filepath.Join("/app/data/uploads", user.Username)
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user directory"})
-		return
-	}
-
-	// Check if file already exists
-	filePath := filepath.Join(userDir, filepath.Base(file.Filename))
-	if _, err := os.Stat(filePath); err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "A file with this name already exists in your folder"})
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
 		return
 	}
+	defer src.Close()
 
-	// Save file to disk
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
+	fileRecord, err := storeFile(c.Request.Context(), fc.DB, fc.Blobs, user.ID, folderID, file.Filename, existing, src, file.Size)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
-	// Store only the relative path (username/filename) in the database
-	relativePath := filepath.Join(user.Username, filepath.Base(file.Filename))
+	fc.Hooks.Enqueue(user.ID, models.EventFileUploaded, gin.H{"file": fileRecord})
 
-	// Create file record in database
-	fileRecord := models.File{
-		Name:     file.Filename,
-		Location: relativePath,
-		UserID:   userID.(uint),
-		Size:     file.Size,
-		Public:   false, // Default to private
-	}
-
-	if result := fc.DB.Create(&fileRecord); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record file in database"})
-		return
+	message := "File uploaded successfully"
+	if existing != nil {
+		message = "New file version uploaded successfully"
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "File uploaded successfully",
+		"message": message,
 		"file":    fileRecord,
 	})
 }
@@ -187,7 +160,61 @@ func (fc *FileController) TogglePublicAccess(c *gin.Context) {
 	})
 }
 
-// DeleteFile removes a file from the system
+// UpdateFile renames a file and/or moves it to another folder. Contents are
+// stored by hash, so only the record changes and access links keep working.
+func (fc *FileController) UpdateFile(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Name     *string `json:"name"`
+		FolderID *uint   `json:"folder_id"` // 0 moves the file to the root
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if requestBody.Name != nil {
+		name := strings.TrimSpace(*requestBody.Name)
+		if !validName(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+			return
+		}
+		file.Name = name
+	}
+
+	if requestBody.FolderID != nil {
+		folderID, ok := resolveFolderID(c, fc.DB, file.UserID, *requestBody.FolderID)
+		if !ok {
+			return
+		}
+		file.FolderID = folderID
+	}
+
+	existing, ok := findExistingFile(c, fc.DB, file.UserID, file.FolderID, file.Name)
+	if !ok {
+		return
+	}
+	if existing != nil && existing.ID != file.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "A file with this name already exists in the destination folder"})
+		return
+	}
+
+	if err := fc.DB.Model(&file).Select("Name", "FolderID").Updates(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File updated successfully",
+		"file":    file,
+	})
+}
+
+// DeleteFile moves a file to the trash, disabling its access links
 func (fc *FileController) DeleteFile(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -213,28 +240,25 @@ func (fc *FileController) DeleteFile(c *gin.Context) {
 		return
 	}
 
-	// Delete any associated accesses first (cascade delete)
-	if err := fc.DB.Where("file_id = ?", uint(fileID)).Delete(&models.Access{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file accesses"})
-		return
-	}
-
-	// Reconstruct the full file path to delete the physical file
-	fullPath := filepath.Join("/app/data/uploads", file.Location)
-
-	// Delete the file record
-	if err := fc.DB.Delete(&file).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file record"})
+	// Move the file and its accesses to the trash. Both get the same deletion
+	// time so that restoring the file brings back exactly these accesses.
+	// The stored content is kept until the trash is purged.
+	deletedAt := time.Now().Truncate(time.Microsecond)
+	err = fc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Access{}).Where("file_id = ?", file.ID).Update("deleted_at", deletedAt).Error; err != nil {
+			return err
+		}
+		return tx.Model(&file).Update("deleted_at", deletedAt).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file to trash"})
 		return
 	}
 
-	// Delete the physical file from the host system
-	if err := os.Remove(fullPath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete the physical file"})
-		return
-	}
+	file.DeletedAt = gorm.DeletedAt{Time: deletedAt, Valid: true}
+	fc.Hooks.Enqueue(file.UserID, models.EventFileDeleted, gin.H{"file": file})
 
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "File moved to trash"})
 }
 
 // GetUserStats returns file count and storage usage for the current user
@@ -252,9 +276,9 @@ func (fc *FileController) GetUserStats(c *gin.Context) {
 		return
 	}
 
-	// Get current storage usage
-	var totalSize int64
-	if err := fc.DB.Model(&models.File{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&totalSize).Error; err != nil {
+	// Get current storage usage, including retained versions
+	totalSize, err := storageUsed(fc.DB, userID.(uint))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get storage usage"})
 		return
 	}
@@ -289,3 +313,123 @@ func (fc *FileController) GetUserStats(c *gin.Context) {
 		"file_types":    fileStats,
 	})
 }
+
+// storeFile streams r into deduplicated storage, hashing it on the way. Without
+// an existing file it records a new private file in the given folder; otherwise
+// the content becomes the newest version of the existing file.
+func storeFile(ctx context.Context, db *gorm.DB, blobs *storage.Blobs, userID uint, folderID *uint, name string, existing *models.File, r io.Reader, size int64) (models.File, error) {
+	blob, err := blobs.Put(ctx, r, size)
+	if err != nil {
+		return models.File{}, err
+	}
+
+	var fileRecord models.File
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if existing != nil {
+			fileRecord, err = addVersion(tx, existing.ID, blob.Size, blob.Hash, blob.Location)
+			return err
+		}
+
+		fileRecord = models.File{
+			Name:     name,
+			Location: blob.Location,
+			UserID:   userID,
+			Size:     blob.Size,
+			Hash:     blob.Hash,
+			Version:  1,
+			FolderID: folderID,
+			Public:   false, // Default to private
+		}
+		if err := tx.Create(&fileRecord).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.FileVersion{
+			FileID:   fileRecord.ID,
+			Version:  1,
+			Size:     blob.Size,
+			Hash:     blob.Hash,
+			Location: blob.Location,
+		}).Error
+	})
+	if err != nil {
+		blobs.Release(ctx, blob.Hash)
+		return models.File{}, err
+	}
+	return fileRecord, nil
+}
+
+// addVersion records stored content as the newest version of a file and makes
+// it the file's current content. The caller must hold a blob reference for it.
+func addVersion(tx *gorm.DB, fileID uint, size int64, hash, location string) (models.File, error) {
+	var file models.File
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&file, fileID).Error; err != nil {
+		return models.File{}, err
+	}
+
+	// The current version is always the highest one, restores included
+	file.Version++
+	file.Size = size
+	file.Hash = hash
+	file.Location = location
+
+	if err := tx.Create(&models.FileVersion{
+		FileID:   file.ID,
+		Version:  file.Version,
+		Size:     size,
+		Hash:     hash,
+		Location: location,
+	}).Error; err != nil {
+		return models.File{}, err
+	}
+	if err := tx.Model(&file).Select("Version", "Size", "Hash", "Location").Updates(&file).Error; err != nil {
+		return models.File{}, err
+	}
+	return file, nil
+}
+
+// releaseContent frees the stored content of a single version. Content that
+// was never migrated to deduplicated storage is owned by the version outright.
+func releaseContent(ctx context.Context, blobs *storage.Blobs, version models.FileVersion) error {
+	if version.Hash == "" {
+		return blobs.Backend.Delete(ctx, version.Location)
+	}
+	return blobs.Release(ctx, version.Hash)
+}
+
+// releaseFileContent deletes every version of a file within tx and drops
+// their references to the stored content. It returns a function deleting the
+// content nothing references anymore, to be called once tx is committed.
+func releaseFileContent(tx *gorm.DB, blobs *storage.Blobs, fileID uint) (func(context.Context), error) {
+	var versions []models.FileVersion
+	if err := tx.Where("file_id = ?", fileID).Find(&versions).Error; err != nil {
+		return nil, err
+	}
+
+	var released, legacy []string
+	for _, version := range versions {
+		if err := tx.Delete(&version).Error; err != nil {
+			return nil, err
+		}
+		// Content that was never migrated to deduplicated storage is owned by the version outright
+		if version.Hash == "" {
+			legacy = append(legacy, version.Location)
+			continue
+		}
+		unreferenced, err := blobs.ReleaseTx(tx, version.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if unreferenced {
+			released = append(released, version.Hash)
+		}
+	}
+
+	return func(ctx context.Context) {
+		for _, location := range legacy {
+			if err := blobs.Backend.Delete(ctx, location); err != nil {
+				log.Printf("Failed to delete content at %s: %v", location, err)
+			}
+		}
+		blobs.Collect(ctx, released...)
+	}, nil
+}
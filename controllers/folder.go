@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type FolderController struct {
+	DB *gorm.DB
+}
+
+// NewFolderController creates a new folder controller
+func NewFolderController(db *gorm.DB) *FolderController {
+	return &FolderController{DB: db}
+}
+
+// inFolder restricts a files or folders query to the direct contents of a folder (nil for the root)
+func inFolder(query *gorm.DB, column string, folderID *uint) *gorm.DB {
+	if folderID == nil {
+		return query.Where(column + " IS NULL")
+	}
+	return query.Where(column+" = ?", *folderID)
+}
+
+// validName rejects empty file and folder names and names that look like paths
+func validName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// parseFolderID resolves a folder ID given by the client ("" or "0" for the root)
+// and checks that the folder belongs to the user. It writes the error response
+// and returns false if the folder is invalid.
+func parseFolderID(c *gin.Context, db *gorm.DB, userID uint, raw string) (*uint, bool) {
+	if raw == "" || raw == "0" {
+		return nil, true
+	}
+
+	id, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return nil, false
+	}
+	return resolveFolderID(c, db, userID, uint(id))
+}
+
+// resolveFolderID is parseFolderID for an already numeric ID (0 for the root)
+func resolveFolderID(c *gin.Context, db *gorm.DB, userID uint, id uint) (*uint, bool) {
+	if id == 0 {
+		return nil, true
+	}
+
+	var folder models.Folder
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&folder).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return nil, false
+	}
+
+	folderID := folder.ID
+	return &folderID, true
+}
+
+// checkFolderNameAvailable writes a conflict response and returns false if the
+// parent folder already contains a folder with this name
+func checkFolderNameAvailable(c *gin.Context, db *gorm.DB, userID uint, parentID *uint, name string, excludeID uint) bool {
+	var existing int64
+	query := inFolder(db.Model(&models.Folder{}), "parent_id", parentID).
+		Where("user_id = ? AND name = ? AND id <> ?", userID, name, excludeID)
+	if err := query.Count(&existing).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing folders"})
+		return false
+	}
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with this name already exists here"})
+		return false
+	}
+	return true
+}
+
+// CreateFolder creates a folder at the root or inside another folder
+func (fc *FolderController) CreateFolder(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var requestBody struct {
+		Name     string `json:"name"`
+		ParentID uint   `json:"parent_id"` // 0 for the root
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if !validName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+		return
+	}
+
+	parentID, ok := resolveFolderID(c, fc.DB, userID.(uint), requestBody.ParentID)
+	if !ok {
+		return
+	}
+
+	if !checkFolderNameAvailable(c, fc.DB, userID.(uint), parentID, name, 0) {
+		return
+	}
+
+	folder := models.Folder{
+		Name:     name,
+		ParentID: parentID,
+		UserID:   userID.(uint),
+	}
+	if err := fc.DB.Create(&folder).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Folder created successfully",
+		"folder":  folder,
+	})
+}
+
+// ListRoot returns the folders and files at the root of the user's drive
+func (fc *FolderController) ListRoot(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	folders, files, ok := fc.listContents(c, userID.(uint), nil)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"folder":  nil,
+		"folders": folders,
+		"files":   files,
+	})
+}
+
+// GetFolder returns a folder with its subfolders and files
+func (fc *FolderController) GetFolder(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	folder, ok := fc.findFolder(c, userID.(uint))
+	if !ok {
+		return
+	}
+
+	folders, files, ok := fc.listContents(c, userID.(uint), &folder.ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"folder":  folder,
+		"folders": folders,
+		"files":   files,
+	})
+}
+
+// UpdateFolder renames a folder and/or moves it under another parent
+func (fc *FolderController) UpdateFolder(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	folder, ok := fc.findFolder(c, userID.(uint))
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Name     *string `json:"name"`
+		ParentID *uint   `json:"parent_id"` // 0 moves the folder to the root
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if requestBody.Name != nil {
+		name := strings.TrimSpace(*requestBody.Name)
+		if !validName(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+			return
+		}
+		folder.Name = name
+	}
+
+	if requestBody.ParentID != nil {
+		parentID, ok := resolveFolderID(c, fc.DB, userID.(uint), *requestBody.ParentID)
+		if !ok {
+			return
+		}
+
+		// A folder cannot be moved into itself or one of its descendants
+		if parentID != nil {
+			isDescendant, err := fc.isSelfOrDescendant(*parentID, folder.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check folder hierarchy"})
+				return
+			}
+			if isDescendant {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A folder cannot be moved into itself or one of its subfolders"})
+				return
+			}
+		}
+		folder.ParentID = parentID
+	}
+
+	if !checkFolderNameAvailable(c, fc.DB, userID.(uint), folder.ParentID, folder.Name, folder.ID) {
+		return
+	}
+
+	if err := fc.DB.Model(&folder).Select("Name", "ParentID").Updates(&folder).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Folder updated successfully",
+		"folder":  folder,
+	})
+}
+
+// DeleteFolder removes an empty folder
+func (fc *FolderController) DeleteFolder(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	folder, ok := fc.findFolder(c, userID.(uint))
+	if !ok {
+		return
+	}
+
+	var subfolders, files int64
+	if err := fc.DB.Model(&models.Folder{}).Where("parent_id = ?", folder.ID).Count(&subfolders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check folder contents"})
+		return
+	}
+	if err := fc.DB.Model(&models.File{}).Where("folder_id = ?", folder.ID).Count(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check folder contents"})
+		return
+	}
+	if subfolders > 0 || files > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Folder is not empty",
+			"folders": subfolders,
+			"files":   files,
+		})
+		return
+	}
+
+	if err := fc.DB.Delete(&folder).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Folder deleted successfully"})
+}
+
+// findFolder loads the folder named in the URL and checks that the user owns it
+func (fc *FolderController) findFolder(c *gin.Context, userID uint) (models.Folder, bool) {
+	folderID, err := strconv.ParseUint(c.Param("folderID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return models.Folder{}, false
+	}
+
+	var folder models.Folder
+	if err := fc.DB.First(&folder, uint(folderID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return models.Folder{}, false
+	}
+
+	if folder.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this folder"})
+		return models.Folder{}, false
+	}
+
+	return folder, true
+}
+
+// listContents returns the direct subfolders and files of a folder (nil for the root)
+func (fc *FolderController) listContents(c *gin.Context, userID uint, folderID *uint) ([]models.Folder, []models.File, bool) {
+	var folders []models.Folder
+	if err := inFolder(fc.DB.Where("user_id = ?", userID), "parent_id", folderID).Order("name").Find(&folders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folders"})
+		return nil, nil, false
+	}
+
+	var files []models.File
+	if err := inFolder(fc.DB.Where("user_id = ?", userID), "folder_id", folderID).Order("name").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve files"})
+		return nil, nil, false
+	}
+
+	return folders, files, true
+}
+
+// isSelfOrDescendant walks up from folderID and reports whether ancestorID is on the path
+func (fc *FolderController) isSelfOrDescendant(folderID, ancestorID uint) (bool, error) {
+	current := &folderID
+	for current != nil {
+		if *current == ancestorID {
+			return true, nil
+		}
+		var folder models.Folder
+		if err := fc.DB.Select("id", "parent_id").First(&folder, *current).Error; err != nil {
+			return false, err
+		}
+		current = folder.ParentID
+	}
+	return false, nil
+}
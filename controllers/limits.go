@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// storageUsed returns the bytes a user stores, counting every retained version
+// of their files. Files in the trash still occupy storage until they are purged.
+func storageUsed(db *gorm.DB, userID uint) (int64, error) {
+	var used int64
+	err := db.Model(&models.FileVersion{}).
+		Joins("JOIN files ON files.id = file_versions.file_id").
+		Where("files.user_id = ?", userID).
+		Select("COALESCE(SUM(file_versions.size), 0)").
+		Scan(&used).Error
+	return used, err
+}
+
+// pendingUploadsOf selects the unfinished uploads of a user that have not expired
+func pendingUploadsOf(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Model(&models.Upload{}).Where("user_id = ? AND expires_at > ?", userID, time.Now())
+}
+
+// checkUploadLimits verifies that the user can store size more bytes and, for
+// a new file rather than a new version of an existing one, one more file.
+// Space reserved by unfinished resumable uploads that have not expired counts
+// towards both limits.
+// It writes the error response and returns false if a limit would be exceeded.
+func checkUploadLimits(c *gin.Context, db *gorm.DB, user models.User, size int64, newFile bool) bool {
+	// Check current file count
+	var currentFileCount, pendingUploads int64
+	if err := db.Model(&models.File{}).Where("user_id = ?", user.ID).Count(&currentFileCount).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check current file count"})
+		return false
+	}
+	if err := pendingUploadsOf(db, user.ID).Count(&pendingUploads).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check pending uploads"})
+		return false
+	}
+
+	// Check file limit
+	if newFile && currentFileCount+pendingUploads >= int64(user.MaxFiles) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":           "File limit exceeded",
+			"current_files":   currentFileCount,
+			"pending_uploads": pendingUploads,
+			"max_files":       user.MaxFiles,
+		})
+		return false
+	}
+
+	// Check current storage usage
+	var reservedStorage int64
+	currentStorage, err := storageUsed(db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check current storage usage"})
+		return false
+	}
+	if err := pendingUploadsOf(db, user.ID).Select("COALESCE(SUM(length), 0)").Scan(&reservedStorage).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check pending uploads"})
+		return false
+	}
+
+	// Check storage limit
+	if currentStorage+reservedStorage+size > user.MaxStorage {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":            "Storage limit exceeded",
+			"current_storage":  currentStorage,
+			"reserved_storage": reservedStorage,
+			"max_storage":      user.MaxStorage,
+			"file_size":        size,
+		})
+		return false
+	}
+
+	return true
+}
+
+// findExistingFile looks up the file with this name in a folder (nil for the root).
+// Uploading to an existing name adds a new version to that file. It writes the
+// error response and returns false if the lookup fails.
+func findExistingFile(c *gin.Context, db *gorm.DB, userID uint, folderID *uint, name string) (*models.File, bool) {
+	var files []models.File
+	query := inFolder(db.Where("user_id = ? AND name = ?", userID, name), "folder_id", folderID)
+	if err := query.Limit(1).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing files"})
+		return nil, false
+	}
+	if len(files) == 0 {
+		return nil, true
+	}
+	return &files[0], true
+}
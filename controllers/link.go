@@ -2,23 +2,26 @@ package controllers
 
 import (
 	"defdrive/models"
+	"defdrive/storage"
+	"errors"
+	"fmt"
 	// "net"
 	"net/http"
-	"path/filepath"
-
-	// "time"
+	"net/url"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type LinkController struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	Storage storage.Backend
 }
 
 // NewLinkController creates a new link controller
-func NewLinkController(db *gorm.DB) *LinkController {
-	return &LinkController{DB: db}
+func NewLinkController(db *gorm.DB, store storage.Backend) *LinkController {
+	return &LinkController{DB: db, Storage: store}
 }
 
 // HandleAccessLink processes access links at /link/:hash
@@ -32,9 +35,9 @@ func (lc *LinkController) HandleAccessLink(c *gin.Context) {
 		return
 	}
 
-	// Fetch the file details with user information
+	// Fetch the file details
 	var file models.File
-	if err := lc.DB.Preload("User").Where("id = ?", access.FileID).First(&file).Error; err != nil {
+	if err := lc.DB.Where("id = ?", access.FileID).First(&file).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
@@ -93,19 +96,44 @@ func (lc *LinkController) HandleAccessLink(c *gin.Context) {
 	// 	}
 	// }
 
-	// // Check one-time use restriction
-	// if access.OneTimeUse && access.Used {
-	// 	c.JSON(http.StatusForbidden, gin.H{"error": "Access link has already been used"})
-	// 	return
-	// }
+	// Links serve the file's current version unless pinned to a specific one
+	version, err := models.ServedVersion(lc.DB, access, file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File version not found"})
+		return
+	}
 
-	// // Mark as used if one-time use
-	// if access.OneTimeUse {
-	// 	access.Used = true
-	// 	lc.DB.Save(&access)
-	// }
+	// Serve the file as a download from the storage backend using the version's Location field
+	serveObject(c, lc.Storage, version.Location, file.Name, version.ETag(), version.CreatedAt)
+}
 
-	// Serve the file as a download using the Location field with username in path
-	filePath := filepath.Join("/app/data/uploads", file.User.Username, filepath.Base(file.Location))
-	c.FileAttachment(filePath, file.Name)
+// serveObject streams a stored object to the client as an attachment.
+// http.ServeContent answers Range, If-Range, If-None-Match and If-Modified-Since
+// requests with 206 and 304 responses based on the given validators.
+func serveObject(c *gin.Context, store storage.Backend, key, name, etag string, modTime time.Time) {
+	obj, err := store.Get(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File content not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer obj.Close()
+
+	c.Header("Content-Disposition", contentDisposition(name))
+	c.Header("ETag", etag)
+	c.Header("Accept-Ranges", "bytes")
+	http.ServeContent(c.Writer, c.Request, name, modTime, obj)
+}
+
+// contentDisposition builds an attachment header, escaping non-ASCII names like gin's FileAttachment
+func contentDisposition(name string) string {
+	for _, r := range name {
+		if r > 127 || r == '"' || r == '\\' {
+			return "attachment; filename*=UTF-8''" + url.QueryEscape(name)
+		}
+	}
+	return fmt.Sprintf("attachment; filename=\"%s\"", name)
 }
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"defdrive/lockout"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LockoutController struct {
+	Limiter *lockout.Limiter
+}
+
+// NewLockoutController creates a new lockout administration controller
+func NewLockoutController(limiter *lockout.Limiter) *LockoutController {
+	return &LockoutController{Limiter: limiter}
+}
+
+// retryAfterSeconds rounds a wait time up to whole seconds for the Retry-After header
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// checkLoginAllowed reserves a login attempt for the given keys, rejecting it
+// if any of them is backing off or locked out. It writes a 429 response and
+// returns false if so. A reserved attempt counts as failed until loginPassed
+// takes it back.
+func checkLoginAllowed(c *gin.Context, limiter *lockout.Limiter, attempts []lockout.Attempt) (*lockout.Reservation, bool) {
+	reservation, wait, err := limiter.Reserve(c.Request.Context(), attempts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return nil, false
+	}
+	if wait > 0 {
+		seconds := retryAfterSeconds(wait)
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Too many failed login attempts, try again later",
+			"retry_after": seconds,
+		})
+		return nil, false
+	}
+	return reservation, true
+}
+
+// loginPassed takes back the reserved attempt once the credentials are valid
+func loginPassed(c *gin.Context, limiter *lockout.Limiter, reservation *lockout.Reservation) {
+	if err := limiter.Release(c.Request.Context(), reservation); err != nil {
+		log.Printf("Failed to release login attempt: %v", err)
+	}
+}
+
+// loginFailed records a failed login attempt and writes a 401 response with message
+func loginFailed(c *gin.Context, limiter *lockout.Limiter, reservation *lockout.Reservation, message string) {
+	wait, err := limiter.Fail(c.Request.Context(), reservation)
+	if err != nil {
+		log.Printf("Failed to record failed login: %v", err)
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+// ListLockouts returns the usernames and IP addresses with failed logins (admin endpoint)
+func (lc *LockoutController) ListLockouts(c *gin.Context) {
+	states, err := lc.Limiter.Store.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get lockouts"})
+		return
+	}
+
+	now := time.Now()
+	lockouts := make([]gin.H, 0, len(states))
+	for _, state := range states {
+		entry := gin.H{
+			"key":          state.Key,
+			"failures":     state.Failures,
+			"last_failure": state.LastFailure,
+			"locked":       state.LockedUntil.After(now),
+		}
+		if state.LockedUntil.After(now) {
+			entry["locked_until"] = state.LockedUntil
+		}
+		lockouts = append(lockouts, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// ClearLockout resets the failures of a key such as "user:alice" or "ip:192.0.2.1" (admin endpoint)
+func (lc *LockoutController) ClearLockout(c *gin.Context) {
+	if err := lc.Limiter.Store.Reset(c.Request.Context(), c.Param("key")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared successfully"})
+}
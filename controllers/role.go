@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type RoleController struct {
+	DB *gorm.DB
+}
+
+// NewRoleController creates a new role controller
+func NewRoleController(db *gorm.DB) *RoleController {
+	return &RoleController{DB: db}
+}
+
+// AdminUsernames returns the usernames listed in ADMIN_USERNAMES, which are
+// given the admin role on startup if they exist and no administrator exists
+// yet. Signing up with one of these names does not make a user an administrator.
+func AdminUsernames() []string {
+	var usernames []string
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// checkPermissions validates the permissions requested for a custom role.
+// It writes the error response and returns false if one is unknown.
+func checkPermissions(c *gin.Context, permissions []string) bool {
+	for _, permission := range permissions {
+		if !models.ValidPermission(permission) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":       "Unknown permission: " + permission,
+				"permissions": models.Permissions,
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// checkGrantable rejects granting, editing or assigning a role with
+// permissions the caller's own role (set by AdminRequired) does not hold,
+// so that nobody can raise their own or anyone else's privileges
+func checkGrantable(c *gin.Context, permissions []string) bool {
+	value, exists := c.Get("role")
+	caller, ok := value.(models.Role)
+	if !exists || !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Administrator access required"})
+		return false
+	}
+	for _, permission := range permissions {
+		if !caller.Has(permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot grant a permission you do not have: " + permission})
+			return false
+		}
+	}
+	return true
+}
+
+// ListRoles returns all roles and the permissions that can be granted
+func (rc *RoleController) ListRoles(c *gin.Context) {
+	var roles []models.Role
+	if err := rc.DB.Order("name").Find(&roles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"roles":       roles,
+		"permissions": models.Permissions,
+	})
+}
+
+// CreateRole creates a custom role
+func (rc *RoleController) CreateRole(c *gin.Context) {
+	var requestBody struct {
+		Name        string   `json:"name" binding:"required"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role name is required"})
+		return
+	}
+	if !checkPermissions(c, requestBody.Permissions) || !checkGrantable(c, requestBody.Permissions) {
+		return
+	}
+
+	var count int64
+	rc.DB.Model(&models.Role{}).Where("name = ?", name).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A role with this name already exists"})
+		return
+	}
+
+	role := models.Role{
+		Name:        name,
+		Description: requestBody.Description,
+		Permissions: requestBody.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	if err := rc.DB.Create(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Role created successfully",
+		"role":    role,
+	})
+}
+
+// UpdateRole changes the description and/or permissions of a custom role
+func (rc *RoleController) UpdateRole(c *gin.Context) {
+	role, ok := rc.findCustomRole(c)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Only callers holding every permission of the role may change it
+	if !checkGrantable(c, role.Permissions) {
+		return
+	}
+
+	if requestBody.Description != nil {
+		role.Description = *requestBody.Description
+	}
+	if requestBody.Permissions != nil {
+		if !checkPermissions(c, requestBody.Permissions) || !checkGrantable(c, requestBody.Permissions) {
+			return
+		}
+		role.Permissions = requestBody.Permissions
+	}
+
+	if err := rc.DB.Model(&role).Select("Description", "Permissions").Updates(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Role updated successfully",
+		"role":    role,
+	})
+}
+
+// DeleteRole deletes a custom role that is not assigned to any user
+func (rc *RoleController) DeleteRole(c *gin.Context) {
+	role, ok := rc.findCustomRole(c)
+	if !ok {
+		return
+	}
+
+	var assigned int64
+	if err := rc.DB.Model(&models.User{}).Where("role = ?", role.Name).Count(&assigned).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check role assignments"})
+		return
+	}
+	if assigned > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role is still assigned to users", "users": assigned})
+		return
+	}
+
+	// Hard delete so that the name can be reused
+	if err := rc.DB.Unscoped().Delete(&role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+}
+
+// SetUserRole assigns a role to a user. Callers can only assign roles whose
+// permissions they hold themselves, and the last administrator cannot be demoted.
+func (rc *RoleController) SetUserRole(c *gin.Context) {
+	var requestBody struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	var user models.User
+	if err := rc.DB.First(&user, c.Param("userID")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var role models.Role
+	if err := rc.DB.Where("name = ?", requestBody.Role).First(&role).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role not found"})
+		return
+	}
+
+	// The caller must hold every permission of the new role, and of the user's
+	// current one so that users with more privileges cannot be demoted
+	if !checkGrantable(c, role.Permissions) {
+		return
+	}
+	var current models.Role
+	if err := rc.DB.Where("name = ?", user.Role).First(&current).Error; err == nil && !checkGrantable(c, current.Permissions) {
+		return
+	}
+
+	if user.Role == models.RoleAdmin && role.Name != models.RoleAdmin {
+		var admins int64
+		if err := rc.DB.Model(&models.User{}).Where("role = ? AND id <> ?", models.RoleAdmin, user.ID).Count(&admins).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check administrators"})
+			return
+		}
+		if admins == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the last administrator"})
+			return
+		}
+	}
+
+	if err := rc.DB.Model(&user).Update("role", role.Name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User role updated successfully",
+		"user": gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+			"role":     role.Name,
+		},
+	})
+}
+
+// findCustomRole loads the role named in the URL, rejecting built-in roles
+func (rc *RoleController) findCustomRole(c *gin.Context) (models.Role, bool) {
+	var role models.Role
+	if err := rc.DB.Where("name = ?", c.Param("role")).First(&role).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return models.Role{}, false
+	}
+	if role.BuiltIn {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Built-in roles cannot be changed"})
+		return models.Role{}, false
+	}
+	return role, true
+}
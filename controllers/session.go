@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"defdrive/models"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Default token lifetimes, overridable with ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type SessionController struct {
+	DB *gorm.DB
+}
+
+// NewSessionController creates a new session controller
+func NewSessionController(db *gorm.DB) *SessionController {
+	return &SessionController{DB: db}
+}
+
+// randomToken returns a URL-safe random string with n bytes of entropy
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// signAccessToken creates a short-lived JWT bound to a session
+func signAccessToken(user models.User, sessionID string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(durationFromEnv("ACCESS_TOKEN_TTL", defaultAccessTokenTTL))
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userID":   user.ID,
+		"username": user.Username,
+		"role":     user.Role, // Informational only; admin routes check the database
+		"sid":      sessionID,
+		"exp":      expiresAt.Unix(),
+	})
+
+	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return tokenString, expiresAt, err
+}
+
+// newRefreshToken returns a refresh token for a session ("<sessionID>.<secret>") and its hash
+func newRefreshToken(sessionID string) (string, string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	token := sessionID + "." + secret
+	return token, models.HashToken(token), nil
+}
+
+// tokenResponse builds the token part of login and refresh responses
+func tokenResponse(user models.User, session models.Session, refreshToken string) (gin.H, error) {
+	accessToken, expiresAt, err := signAccessToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":              accessToken,
+		"token_expires_at":   expiresAt,
+		"refresh_token":      refreshToken,
+		"refresh_expires_at": session.ExpiresAt,
+	}, nil
+}
+
+// startSession creates a session for a user who just logged in and returns its tokens
+func startSession(c *gin.Context, db *gorm.DB, user models.User) (gin.H, error) {
+	now := time.Now()
+	session := models.Session{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		UserAgent:  c.Request.UserAgent(),
+		ClientIP:   c.ClientIP(),
+		ExpiresAt:  now.Add(durationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)),
+		LastUsedAt: now,
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	session.RefreshHash = refreshHash
+
+	// Drop the user's sessions that can no longer be refreshed
+	db.Where("user_id = ? AND expires_at < ?", user.ID, now).Delete(&models.Session{})
+
+	if err := db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return tokenResponse(user, session, refreshToken)
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. Presenting a refresh token that was already used revokes
+// the whole session, since it means the token was stolen.
+func (sc *SessionController) RefreshToken(c *gin.Context) {
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	sessionID, _, found := strings.Cut(requestBody.RefreshToken, ".")
+	if !found {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	var session models.Session
+	if err := sc.DB.Preload("User").Where("id = ?", sessionID).First(&session).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	now := time.Now()
+	if !session.Active(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+		return
+	}
+
+	presentedHash := models.HashToken(requestBody.RefreshToken)
+	if subtle.ConstantTimeCompare([]byte(presentedHash), []byte(session.RefreshHash)) != 1 {
+		sc.DB.Model(&session).Update("revoked_at", now)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reused, session revoked"})
+		return
+	}
+
+	refreshToken, refreshHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Only one of several concurrent refreshes with the same token can win
+	result := sc.DB.Model(&models.Session{}).
+		Where("id = ? AND refresh_hash = ? AND revoked_at IS NULL", session.ID, presentedHash).
+		Updates(map[string]interface{}{"refresh_hash": refreshHash, "last_used_at": now})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		sc.DB.Model(&session).Update("revoked_at", now)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reused, session revoked"})
+		return
+	}
+
+	tokens, err := tokenResponse(session.User, session, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	tokens["message"] = "Token refreshed successfully"
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the current session, or all of the user's sessions if "all" is set
+func (sc *SessionController) Logout(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var requestBody struct {
+		All bool `json:"all"`
+	}
+	// The body is optional
+	c.ShouldBindJSON(&requestBody)
+
+	query := sc.DB.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if !requestBody.All {
+		query = query.Where("id = ?", c.GetString("sessionID"))
+	}
+
+	if err := query.Update("revoked_at", time.Now()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// ListSessions returns the current user's active sessions
+func (sc *SessionController) ListSessions(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var sessions []models.Session
+	if err := sc.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current_session": c.GetString("sessionID"),
+		"sessions":        sessions,
+	})
+}
+
+// RevokeSession revokes one of the current user's sessions, e.g. on a lost device
+func (sc *SessionController) RevokeSession(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	result := sc.DB.Model(&models.Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("sessionID"), userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type TokenController struct {
+	DB *gorm.DB
+}
+
+// NewTokenController creates a new personal access token controller
+func NewTokenController(db *gorm.DB) *TokenController {
+	return &TokenController{DB: db}
+}
+
+// CreateToken creates a personal access token. The token itself is only
+// returned in this response; afterwards only its prefix is shown.
+func (tc *TokenController) CreateToken(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var requestBody struct {
+		Name      string     `json:"name" binding:"required"`
+		Scopes    []string   `json:"scopes" binding:"required"`
+		ExpiresIn string     `json:"expires_in"` // Duration such as "720h"
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	name := strings.TrimSpace(requestBody.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token name is required"})
+		return
+	}
+
+	if len(requestBody.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required", "scopes": models.Scopes})
+		return
+	}
+	for _, scope := range requestBody.Scopes {
+		if !models.ValidScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope, "scopes": models.Scopes})
+			return
+		}
+	}
+
+	expiresAt := requestBody.ExpiresAt
+	if requestBody.ExpiresIn != "" {
+		d, err := time.ParseDuration(requestBody.ExpiresIn)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_in duration"})
+			return
+		}
+		t := time.Now().Add(d)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	tokenString := models.TokenPrefix + secret
+
+	token := models.PersonalAccessToken{
+		Name:      name,
+		Prefix:    tokenString[:len(models.TokenPrefix)+6],
+		TokenHash: models.HashToken(tokenString),
+		Scopes:    requestBody.Scopes,
+		ExpiresAt: expiresAt,
+		UserID:    userID.(uint),
+	}
+	if err := tc.DB.Create(&token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Token created successfully. Store it now, it will not be shown again.",
+		"token":          tokenString,
+		"personal_token": token,
+	})
+}
+
+// ListTokens returns the current user's personal access tokens that have not been revoked
+func (tc *TokenController) ListTokens(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var tokens []models.PersonalAccessToken
+	if err := tc.DB.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at DESC").Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeToken revokes one of the current user's personal access tokens
+func (tc *TokenController) RevokeToken(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	result := tc.DB.Model(&models.PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("tokenID"), userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
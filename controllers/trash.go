@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"context"
+	"defdrive/models"
+	"defdrive/storage"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Default trash settings, overridable with TRASH_RETENTION and TRASH_PURGE_INTERVAL
+const (
+	defaultTrashRetention     = 30 * 24 * time.Hour
+	defaultTrashPurgeInterval = time.Hour
+)
+
+type TrashController struct {
+	DB        *gorm.DB
+	Blobs     *storage.Blobs
+	Retention time.Duration
+}
+
+// NewTrashController creates a new trash controller
+func NewTrashController(db *gorm.DB, blobs *storage.Blobs) *TrashController {
+	return &TrashController{DB: db, Blobs: blobs, Retention: TrashRetention()}
+}
+
+// TrashRetention returns how long deleted files stay in the trash (TRASH_RETENTION)
+func TrashRetention() time.Duration {
+	return durationFromEnv("TRASH_RETENTION", defaultTrashRetention)
+}
+
+// durationFromEnv parses a positive duration from an environment variable, falling back to def
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using %s", key, value, def)
+		return def
+	}
+	return d
+}
+
+// ListTrash returns the current user's deleted files with the time they will be purged
+func (tc *TrashController) ListTrash(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var files []models.File
+	if err := tc.DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userID).Order("deleted_at DESC").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+
+	items := make([]gin.H, 0, len(files))
+	for _, file := range files {
+		items = append(items, gin.H{
+			"file":      file,
+			"purge_at":  file.DeletedAt.Time.Add(tc.Retention),
+			"folder_id": file.FolderID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"trash": items})
+}
+
+// RestoreFile takes a file out of the trash together with the accesses deleted with it
+func (tc *TrashController) RestoreFile(c *gin.Context) {
+	file, ok := tc.findTrashedFile(c)
+	if !ok {
+		return
+	}
+
+	// Without a version there is no content left to serve
+	var versions int64
+	if err := tc.DB.Model(&models.FileVersion{}).Where("file_id = ?", file.ID).Count(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file versions"})
+		return
+	}
+	if versions == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "File content is no longer available and cannot be restored"})
+		return
+	}
+
+	var user models.User
+	if err := tc.DB.First(&user, file.UserID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
+		return
+	}
+
+	// Trashed content still counts towards the storage limit, so only the file count is checked
+	if !checkUploadLimits(c, tc.DB, user, 0, true) {
+		return
+	}
+
+	// Files whose folder was deleted in the meantime are restored to the root
+	folderID := file.FolderID
+	if folderID != nil {
+		var count int64
+		tc.DB.Model(&models.Folder{}).Where("id = ?", *folderID).Count(&count)
+		if count == 0 {
+			folderID = nil
+		}
+	}
+
+	existing, ok := findExistingFile(c, tc.DB, user.ID, folderID, file.Name)
+	if !ok {
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A file with this name already exists in the destination folder"})
+		return
+	}
+
+	err := tc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&models.Access{}).
+			Where("file_id = ? AND deleted_at = ?", file.ID, file.DeletedAt.Time).
+			Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&file).Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"folder_id":  folderID,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file"})
+		return
+	}
+
+	file.DeletedAt = gorm.DeletedAt{}
+	file.FolderID = folderID
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File restored successfully",
+		"file":    file,
+	})
+}
+
+// DeleteFile permanently removes a single file from the trash
+func (tc *TrashController) DeleteFile(c *gin.Context) {
+	file, ok := tc.findTrashedFile(c)
+	if !ok {
+		return
+	}
+
+	if err := purgeFile(c.Request.Context(), tc.DB, tc.Blobs, file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted permanently"})
+}
+
+// EmptyTrash permanently removes all of the current user's trashed files
+func (tc *TrashController) EmptyTrash(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var files []models.File
+	if err := tc.DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userID).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve trash"})
+		return
+	}
+
+	for _, file := range files {
+		if err := purgeFile(c.Request.Context(), tc.DB, tc.Blobs, file); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Trash emptied successfully",
+		"deleted": len(files),
+	})
+}
+
+// findTrashedFile loads the trashed file named in the URL and checks that the user owns it
+func (tc *TrashController) findTrashedFile(c *gin.Context) (models.File, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.File{}, false
+	}
+
+	fileID, err := strconv.ParseUint(c.Param("fileID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return models.File{}, false
+	}
+
+	var file models.File
+	if err := tc.DB.Unscoped().Where("deleted_at IS NOT NULL").First(&file, uint(fileID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		return models.File{}, false
+	}
+
+	if file.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this file"})
+		return models.File{}, false
+	}
+
+	return file, true
+}
+
+// purgeFile permanently deletes a trashed file, its accesses and its versions,
+// releasing the stored content
+func purgeFile(ctx context.Context, db *gorm.DB, blobs *storage.Blobs, file models.File) error {
+	var deleteContent func(context.Context)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if deleteContent, err = releaseFileContent(tx, blobs, file.ID); err != nil {
+			return err
+		}
+
+		if err := tx.Where("access_id IN (?)", tx.Unscoped().Model(&models.Access{}).Select("id").Where("file_id = ?", file.ID)).
+			Delete(&models.DownloadSession{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("access_id IN (?)", tx.Unscoped().Model(&models.Access{}).Select("id").Where("file_id = ?", file.ID)).
+			Delete(&models.AccessEvent{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("file_id = ?", file.ID).Delete(&models.Access{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&file).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stored objects are only deleted once nothing in the database points to them
+	deleteContent(ctx)
+	return nil
+}
+
+// PurgeExpiredTrash permanently deletes files that have been in the trash longer than retention
+func PurgeExpiredTrash(ctx context.Context, db *gorm.DB, blobs *storage.Blobs, retention time.Duration) (int, error) {
+	var files []models.File
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-retention)).Find(&files).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, file := range files {
+		if err := purgeFile(ctx, db, blobs, file); err != nil {
+			log.Printf("Failed to purge trashed file %d: %v", file.ID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunTrashPurger periodically purges expired trash until ctx is cancelled
+func RunTrashPurger(ctx context.Context, db *gorm.DB, blobs *storage.Blobs) {
+	retention := TrashRetention()
+	interval := durationFromEnv("TRASH_PURGE_INTERVAL", defaultTrashPurgeInterval)
+	log.Printf("Trash purger started (retention %s, interval %s)", retention, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := PurgeExpiredTrash(ctx, db, blobs, retention)
+		if err != nil {
+			log.Printf("Failed to purge trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d file(s) from the trash", purged)
+		}
+
+		// Retry deleting contents whose storage objects could not be removed before
+		if deleted, err := blobs.DeleteReleased(ctx); err != nil {
+			log.Printf("Failed to delete released contents: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d released content object(s)", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
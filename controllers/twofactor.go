@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"defdrive/lockout"
+	"defdrive/models"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	totpPeriod          = 30 // Seconds per TOTP time step
+	totpSkew            = 1  // Accept codes from one step before and after the current one
+	recoveryCodeCount   = 10
+	challengeTokenTTL   = 5 * time.Minute
+	challengeTokenType  = "2fa_challenge"
+	defaultTOTPIssuer   = "DefDrive"
+	recoveryCodeEntropy = 10 // Random bytes per recovery code
+)
+
+type TwoFactorController struct {
+	DB      *gorm.DB
+	Limiter *lockout.Limiter
+}
+
+// NewTwoFactorController creates a new two-factor authentication controller
+func NewTwoFactorController(db *gorm.DB, limiter *lockout.Limiter) *TwoFactorController {
+	return &TwoFactorController{DB: db, Limiter: limiter}
+}
+
+// signChallengeToken creates the short-lived token that proves a user passed
+// the password step of a login and may now submit their second factor. It has
+// no session ID, so AuthRequired never accepts it.
+func signChallengeToken(user models.User) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userID": user.ID,
+		"typ":    challengeTokenType,
+		"exp":    time.Now().Add(challengeTokenTTL).Unix(),
+	})
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+// parseChallengeToken returns the user ID of a valid challenge token
+func parseChallengeToken(tokenString string) (uint, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.NewValidationError("unexpected signing method", jwt.ValidationErrorSignatureInvalid)
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid {
+		return 0, errors.New("invalid or expired challenge token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	userID, hasUserID := claims["userID"].(float64)
+	if !ok || !hasUserID || claims["typ"] != challengeTokenType {
+		return 0, errors.New("invalid challenge token")
+	}
+	return uint(userID), nil
+}
+
+// verifyTOTP checks a TOTP code against the user's secret. A code is accepted
+// only once: its time step must be newer than the last accepted one.
+func verifyTOTP(db *gorm.DB, user models.User, code string) bool {
+	if user.TOTPSecret == "" {
+		return false
+	}
+
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	now := time.Now()
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(user.TOTPSecret, t, opts)
+		if err != nil || expected != strings.TrimSpace(code) {
+			continue
+		}
+
+		counter := t.Unix() / totpPeriod
+		result := db.Model(&models.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+			Update("totp_last_counter", counter)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+	return false
+}
+
+// normalizeRecoveryCode makes recovery codes case and separator insensitive
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(db *gorm.DB, userID uint, code string) bool {
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, models.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// verifySecondFactor accepts either a TOTP code or a recovery code
+func verifySecondFactor(db *gorm.DB, user models.User, code string) bool {
+	return verifyTOTP(db, user, code) || useRecoveryCode(db, user.ID, code)
+}
+
+// generateRecoveryCodes replaces the user's recovery codes with new ones and returns them
+func generateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeEntropy)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		records = append(records, models.RecoveryCode{UserID: userID, CodeHash: models.HashToken(raw)})
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// currentUser loads the authenticated user. It writes the error response and returns false on failure.
+func currentUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// Status reports whether two-factor authentication is enabled and how many recovery codes are left
+func (tc *TwoFactorController) Status(c *gin.Context) {
+	user, ok := currentUser(c, tc.DB)
+	if !ok {
+		return
+	}
+
+	var remaining int64
+	tc.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining)
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  user.TOTPEnabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// Setup generates a new TOTP secret for the user. Two-factor authentication
+// is only enabled once a code from the authenticator app has been confirmed.
+func (tc *TwoFactorController) Setup(c *gin.Context) {
+	user, ok := currentUser(c, tc.DB)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: user.Username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	if err := tc.DB.Model(&user).Updates(map[string]interface{}{"totp_secret": key.Secret(), "totp_last_counter": 0}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Scan the otpauth URL with an authenticator app and confirm a code to enable two-factor authentication",
+		"secret":      key.Secret(),
+		"otpauth_url": key.URL(),
+	})
+}
+
+// Enable confirms the TOTP secret with a code and returns the recovery codes
+func (tc *TwoFactorController) Enable(c *gin.Context) {
+	user, ok := currentUser(c, tc.DB)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Call setup first"})
+		return
+	}
+	if !verifyTOTP(tc.DB, user, requestBody.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err := tc.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if codes, err = generateRecoveryCodes(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("totp_enabled", true).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled. Store the recovery codes somewhere safe, they will not be shown again.",
+		"recovery_codes": codes,
+	})
+}
+
+// Disable turns off two-factor authentication after checking the password and a code
+func (tc *TwoFactorController) Disable(c *gin.Context) {
+	user, ok := currentUser(c, tc.DB)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"` // TOTP or recovery code
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(requestBody.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+	if !verifySecondFactor(tc.DB, user, requestBody.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := resetTwoFactor(tc.DB, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a TOTP code
+func (tc *TwoFactorController) RegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := currentUser(c, tc.DB)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !verifyTOTP(tc.DB, user, requestBody.Code) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	var codes []string
+	err := tc.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = generateRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Recovery codes regenerated",
+		"recovery_codes": codes,
+	})
+}
+
+// LoginSecondFactor completes a login started with a challenge token by
+// checking a TOTP or recovery code
+func (tc *TwoFactorController) LoginSecondFactor(c *gin.Context) {
+	var requestBody struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code" binding:"required"` // TOTP or recovery code
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	userID, err := parseChallengeToken(requestBody.ChallengeToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+
+	var user models.User
+	if err := tc.DB.First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+
+	// Codes are throttled per challenge token and client IP, and failures count towards the username
+	reservation, ok := checkLoginAllowed(c, tc.Limiter, tc.Limiter.ChallengeAttempts(requestBody.ChallengeToken, user.Username, c.ClientIP()))
+	if !ok {
+		return
+	}
+	if !verifySecondFactor(tc.DB, user, requestBody.Code) {
+		loginFailed(c, tc.Limiter, reservation, "Invalid code")
+		return
+	}
+	loginPassed(c, tc.Limiter, reservation)
+
+	tc.Limiter.Succeed(c.Request.Context(), user.Username)
+	respondLoginSuccess(c, tc.DB, user)
+}
+
+// ResetUser disables two-factor authentication for a user who lost both
+// their authenticator and recovery codes (admin endpoint)
+func (tc *TwoFactorController) ResetUser(c *gin.Context) {
+	var user models.User
+	if err := tc.DB.First(&user, c.Param("userID")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := resetTwoFactor(tc.DB, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Two-factor authentication reset successfully",
+		"user": gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+		},
+	})
+}
+
+// resetTwoFactor disables two-factor authentication and removes the secret and recovery codes
+func resetTwoFactor(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_enabled":      false,
+			"totp_secret":       "",
+			"totp_last_counter": 0,
+		}).Error
+	})
+}
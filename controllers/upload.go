@@ -0,0 +1,490 @@
+package controllers
+
+import (
+	"context"
+	"defdrive/models"
+	"defdrive/storage"
+	"defdrive/webhook"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// tusVersion is the only version of the tus resumable upload protocol we speak
+const tusVersion = "1.0.0"
+
+// Default upload expiration settings, overridable with UPLOAD_EXPIRATION and UPLOAD_PURGE_INTERVAL
+const (
+	defaultUploadExpiration    = 24 * time.Hour
+	defaultUploadPurgeInterval = time.Hour
+)
+
+type UploadController struct {
+	DB         *gorm.DB
+	Blobs      *storage.Blobs
+	Hooks      *webhook.Dispatcher
+	Expiration time.Duration
+}
+
+// NewUploadController creates a new resumable upload controller
+func NewUploadController(db *gorm.DB, blobs *storage.Blobs, hooks *webhook.Dispatcher) *UploadController {
+	return &UploadController{DB: db, Blobs: blobs, Hooks: hooks, Expiration: UploadExpiration()}
+}
+
+// UploadExpiration returns how long an unfinished upload is kept after it last
+// received data (UPLOAD_EXPIRATION)
+func UploadExpiration() time.Duration {
+	return durationFromEnv("UPLOAD_EXPIRATION", defaultUploadExpiration)
+}
+
+// chunkPrefix returns the storage prefix holding the received chunks of an upload
+func chunkPrefix(uploadID string) string {
+	return "uploads/" + uploadID + "/"
+}
+
+// chunkKey names chunks by their zero-padded offset so they list in order. The
+// random suffix keeps a losing concurrent PATCH from overwriting the winner's chunk.
+func chunkKey(uploadID string, offset int64) string {
+	return fmt.Sprintf("%s%020d-%s", chunkPrefix(uploadID), offset, uuid.New().String())
+}
+
+// checkTusResumable sets the protocol header on the response and rejects
+// requests for unsupported protocol versions
+func checkTusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version, expected " + tusVersion})
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header ("key base64value,...")
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for metadata key %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// TusOptions advertises the supported tus version and extensions
+func (uc *UploadController) TusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination,expiration")
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload after checking the user's limits
+func (uc *UploadController) CreateUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Deferred upload length is not supported"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or missing Upload-Length header"})
+		return
+	}
+
+	metadataHeader := c.GetHeader("Upload-Metadata")
+	metadata, err := parseUploadMetadata(metadataHeader)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := filepath.Base(metadata["filename"])
+	if metadata["filename"] == "" || name == "." || name == "/" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must contain a filename"})
+		return
+	}
+
+	var user models.User
+	if err := uc.DB.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
+		return
+	}
+
+	// Files go to the root unless the client names a folder in the metadata
+	folderID, ok := parseFolderID(c, uc.DB, user.ID, metadata["folder_id"])
+	if !ok {
+		return
+	}
+
+	// Uploading to an existing name creates a new version of that file
+	existing, ok := findExistingFile(c, uc.DB, user.ID, folderID, name)
+	if !ok {
+		return
+	}
+
+	// Check file count and storage limits up front so no data is sent in vain
+	if !checkUploadLimits(c, uc.DB, user, length, existing == nil) {
+		return
+	}
+
+	upload := models.Upload{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Length:    length,
+		Metadata:  metadataHeader,
+		FolderID:  folderID,
+		ExpiresAt: time.Now().Add(uc.Expiration),
+		UserID:    user.ID,
+	}
+	if err := uc.DB.Create(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.Header("Location", "/api/uploads/"+upload.ID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	// An empty file is complete as soon as it is created
+	if length == 0 {
+		file, ok := uc.finishUpload(c, upload)
+		if !ok {
+			return
+		}
+		c.Header("DefDrive-File-ID", strconv.FormatUint(uint64(file.ID), 10))
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+// GetUploadOffset reports how many bytes of an upload have been received
+func (uc *UploadController) GetUploadOffset(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	upload, ok := uc.findUpload(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload appends a chunk at the current offset and creates the file once all data has arrived
+func (uc *UploadController) PatchUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	upload, ok := uc.findUpload(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or missing Upload-Offset header"})
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the current offset"})
+		return
+	}
+
+	remaining := upload.Length - upload.Offset
+	if c.Request.ContentLength > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Chunk exceeds the announced Upload-Length"})
+		return
+	}
+
+	// Keep whatever arrived before an interrupted connection so the client can resume from there.
+	// The write must not be tied to the request context, which is cancelled on disconnect.
+	ctx := context.WithoutCancel(c.Request.Context())
+	body := &partialReader{r: io.LimitReader(c.Request.Body, remaining)}
+	key := chunkKey(upload.ID, offset)
+	if err := uc.Blobs.Backend.Put(ctx, key, body, -1); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	if body.n == 0 {
+		uc.Blobs.Backend.Delete(ctx, key)
+	} else {
+		// Only advance from the offset we started at, so concurrent PATCHes cannot both succeed.
+		// Receiving data keeps the upload alive for another expiration period.
+		upload.ExpiresAt = time.Now().Add(uc.Expiration)
+		result := uc.DB.Model(&models.Upload{}).
+			Where("id = ? AND upload_offset = ?", upload.ID, offset).
+			Updates(map[string]interface{}{"upload_offset": offset + body.n, "expires_at": upload.ExpiresAt})
+		if result.Error != nil || result.RowsAffected == 0 {
+			uc.Blobs.Backend.Delete(ctx, key)
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload was modified concurrently"})
+			return
+		}
+		upload.Offset = offset + body.n
+	}
+
+	if body.err != nil {
+		return // Connection is gone; the client resumes from the stored offset
+	}
+
+	if upload.Offset == upload.Length {
+		file, ok := uc.finishUpload(c, upload)
+		if !ok {
+			return
+		}
+		c.Header("DefDrive-File-ID", strconv.FormatUint(uint64(file.ID), 10))
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteUpload terminates an upload and discards the received data
+func (uc *UploadController) DeleteUpload(c *gin.Context) {
+	if !checkTusResumable(c) {
+		return
+	}
+
+	upload, ok := uc.findUpload(c)
+	if !ok {
+		return
+	}
+
+	if err := uc.DB.Delete(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete upload"})
+		return
+	}
+	deleteChunks(c.Request.Context(), uc.Blobs.Backend, upload.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// findUpload loads the upload named in the URL if it belongs to the current user
+func (uc *UploadController) findUpload(c *gin.Context) (models.Upload, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.Upload{}, false
+	}
+
+	var upload models.Upload
+	if err := uc.DB.Where("id = ? AND user_id = ?", c.Param("uploadID"), userID).First(&upload).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return models.Upload{}, false
+	}
+	if !upload.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Upload has expired"})
+		return models.Upload{}, false
+	}
+	return upload, true
+}
+
+// finishUpload concatenates the received chunks into a file and removes the upload
+func (uc *UploadController) finishUpload(c *gin.Context, upload models.Upload) (models.File, bool) {
+	ctx := c.Request.Context()
+
+	// The file may have been created by another upload in the meantime
+	existing, ok := findExistingFile(c, uc.DB, upload.UserID, upload.FolderID, upload.Name)
+	if !ok {
+		return models.File{}, false
+	}
+
+	var keys []string
+	var received int64
+	if err := uc.Blobs.Backend.List(ctx, chunkPrefix(upload.ID), func(obj storage.ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		received += obj.Size
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload chunks"})
+		return models.File{}, false
+	}
+	if received != upload.Length {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Stored chunks do not match the upload length"})
+		return models.File{}, false
+	}
+	sort.Strings(keys)
+
+	r := &chunkReader{ctx: ctx, backend: uc.Blobs.Backend, keys: keys}
+	defer r.Close()
+
+	file, err := storeFile(ctx, uc.DB, uc.Blobs, upload.UserID, upload.FolderID, upload.Name, existing, r, upload.Length)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return models.File{}, false
+	}
+
+	if err := uc.DB.Delete(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return models.File{}, false
+	}
+	deleteChunks(ctx, uc.Blobs.Backend, upload.ID)
+
+	uc.Hooks.Enqueue(upload.UserID, models.EventFileUploaded, gin.H{"file": file})
+	return file, true
+}
+
+// deleteChunks removes every stored chunk of an upload
+func deleteChunks(ctx context.Context, backend storage.Backend, uploadID string) {
+	var keys []string
+	backend.List(ctx, chunkPrefix(uploadID), func(obj storage.ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	for _, key := range keys {
+		backend.Delete(ctx, key)
+	}
+}
+
+// PurgeExpiredUploads deletes unfinished uploads past their expiry together
+// with their stored chunks, returning how many were removed
+func PurgeExpiredUploads(ctx context.Context, db *gorm.DB, blobs *storage.Blobs) (int, error) {
+	// Uploads started before expiration existed get a full period from now
+	if err := db.Model(&models.Upload{}).Where("expires_at IS NULL").
+		Update("expires_at", time.Now().Add(UploadExpiration())).Error; err != nil {
+		return 0, err
+	}
+
+	var uploads []models.Upload
+	if err := db.Where("expires_at <= ?", time.Now()).Find(&uploads).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, upload := range uploads {
+		// Only delete the row if no chunk arrived meanwhile
+		result := db.Where("id = ? AND expires_at <= ?", upload.ID, time.Now()).Delete(&models.Upload{})
+		if result.Error != nil {
+			log.Printf("Failed to purge expired upload %s: %v", upload.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		deleteChunks(ctx, blobs.Backend, upload.ID)
+		purged++
+	}
+	return purged, nil
+}
+
+// RunUploadPurger periodically purges expired uploads until ctx is cancelled
+func RunUploadPurger(ctx context.Context, db *gorm.DB, blobs *storage.Blobs) {
+	ticker := time.NewTicker(durationFromEnv("UPLOAD_PURGE_INTERVAL", defaultUploadPurgeInterval))
+	defer ticker.Stop()
+
+	for {
+		purged, err := PurgeExpiredUploads(ctx, db, blobs)
+		if err != nil {
+			log.Printf("Failed to purge expired uploads: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d expired upload(s)", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// partialReader reports a read error as the end of the stream, remembering it,
+// so that the data received before a dropped connection is still stored
+type partialReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if err != nil && err != io.EOF {
+		p.err = err
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// chunkReader reads the given objects one after another, opening each only when needed
+type chunkReader struct {
+	ctx     context.Context
+	backend storage.Backend
+	keys    []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			obj, err := r.backend.Get(r.ctx, r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.keys = obj, r.keys[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -1,24 +1,28 @@
 package controllers
 
 import (
+	"defdrive/lockout"
+	"defdrive/mailer"
 	"defdrive/models"
+	"log"
 	"net/http"
-	"os"
-	"time"
+	"net/mail"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type UserController struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	Mailer  mailer.Mailer
+	Limiter *lockout.Limiter
 }
 
 // NewUserController creates a new user controller
-func NewUserController(db *gorm.DB) *UserController {
-	return &UserController{DB: db}
+func NewUserController(db *gorm.DB, mail mailer.Mailer, limiter *lockout.Limiter) *UserController {
+	return &UserController{DB: db, Mailer: mail, Limiter: limiter}
 }
 
 // SignUp handles user registration
@@ -37,6 +41,20 @@ func (uc *UserController) SignUp(c *gin.Context) {
 	}
 	user.Password = string(hashedPassword)
 
+	// Roles and limits are assigned by administrators, never by the client
+	user.Role = models.RoleUser
+	user.MaxFiles = 0
+	user.MaxStorage = 0
+	user.EmailVerifiedAt = nil
+
+	user.Email = strings.TrimSpace(user.Email)
+	if user.Email != "" || requireEmailVerification() {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email address is required"})
+			return
+		}
+	}
+
 	// Create the user in the database
 	result := uc.DB.Create(&user)
 	if result.Error != nil {
@@ -44,6 +62,13 @@ func (uc *UserController) SignUp(c *gin.Context) {
 		return
 	}
 
+	// Ask the user to confirm their email address
+	if user.Email != "" {
+		if err := sendVerificationEmail(uc.DB, uc.Mailer, user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
+
 	// Don't return the password in the response
 	user.Password = ""
 	c.JSON(http.StatusOK, gin.H{"message": "User created successfully", "user": user})
@@ -61,41 +86,67 @@ func (uc *UserController) Login(c *gin.Context) {
 		return
 	}
 
+	// Back off after failed attempts for this username or client IP
+	reservation, ok := checkLoginAllowed(c, uc.Limiter, uc.Limiter.LoginAttempts(loginRequest.Username, c.ClientIP()))
+	if !ok {
+		return
+	}
+
 	var user models.User
 	if err := uc.DB.Where("username = ?", loginRequest.Username).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		loginFailed(c, uc.Limiter, reservation, "Invalid username or password")
 		return
 	}
 
 	// Compare the provided password with the stored hash
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginRequest.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		loginFailed(c, uc.Limiter, reservation, "Invalid username or password")
 		return
 	}
+	loginPassed(c, uc.Limiter, reservation)
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"userID":   user.ID,
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
-	})
+	if requireEmailVerification() && user.EmailVerifiedAt == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified", "email_verification_required": true})
+		return
+	}
 
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	// With two-factor authentication the login is completed by LoginSecondFactor
+	if user.TOTPEnabled {
+		challengeToken, err := signChallengeToken(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":             "Two-factor authentication required",
+			"two_factor_required": true,
+			"challenge_token":     challengeToken,
+		})
+		return
+	}
+
+	uc.Limiter.Succeed(c.Request.Context(), user.Username)
+	respondLoginSuccess(c, uc.DB, user)
+}
+
+// respondLoginSuccess starts a session with a short-lived access token and a
+// refresh token for a fully authenticated user
+func respondLoginSuccess(c *gin.Context, db *gorm.DB, user models.User) {
+	response, err := startSession(c, db, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   tokenString,
-		"user": gin.H{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"name":     user.Name,
-		},
-	})
+	response["message"] = "Login successful"
+	response["user"] = gin.H{
+		"id":       user.ID,
+		"username": user.Username,
+		"email":    user.Email,
+		"name":     user.Name,
+		"role":     user.Role,
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // GetUserLimits returns the current user's limits and usage
@@ -119,9 +170,9 @@ func (uc *UserController) GetUserLimits(c *gin.Context) {
 		return
 	}
 
-	// Get current storage usage
-	var currentStorage int64
-	if err := uc.DB.Model(&models.File{}).Where("user_id = ?", userID).Select("COALESCE(SUM(size), 0)").Scan(&currentStorage).Error; err != nil {
+	// Get current storage usage, including retained versions
+	currentStorage, err := storageUsed(uc.DB, user.ID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get current storage usage"})
 		return
 	}
@@ -136,7 +187,7 @@ func (uc *UserController) GetUserLimits(c *gin.Context) {
 	})
 }
 
-// UpdateUserLimits allows updating user limits (admin only for now)
+// UpdateUserLimits allows updating user limits (admin endpoint)
 func (uc *UserController) UpdateUserLimits(c *gin.Context) {
 	userID := c.Param("userID")
 	if userID == "" {
@@ -207,14 +258,14 @@ func (uc *UserController) GetAllUsersLimits(c *gin.Context) {
 		var currentFileCount int64
 		uc.DB.Model(&models.File{}).Where("user_id = ?", user.ID).Count(&currentFileCount)
 
-		// Get current storage usage for each user
-		var currentStorage int64
-		uc.DB.Model(&models.File{}).Where("user_id = ?", user.ID).Select("COALESCE(SUM(size), 0)").Scan(&currentStorage)
+		// Get current storage usage for each user, including retained versions
+		currentStorage, _ := storageUsed(uc.DB, user.ID)
 
 		userLimits = append(userLimits, gin.H{
 			"user_id":           user.ID,
 			"username":          user.Username,
 			"email":             user.Email,
+			"role":              user.Role,
 			"max_files":         user.MaxFiles,
 			"max_storage":       user.MaxStorage,
 			"current_files":     currentFileCount,
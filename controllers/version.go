@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// findUserFile loads the file named in the URL and checks that the current user owns it
+func findUserFile(c *gin.Context, db *gorm.DB) (models.File, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.File{}, false
+	}
+
+	fileID, err := strconv.ParseUint(c.Param("fileID"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return models.File{}, false
+	}
+
+	var file models.File
+	if err := db.First(&file, uint(fileID)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return models.File{}, false
+	}
+
+	// Check if user owns the file
+	if file.UserID != userID.(uint) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to access this file"})
+		return models.File{}, false
+	}
+
+	return file, true
+}
+
+// findFileVersion loads the version named in the URL
+func findFileVersion(c *gin.Context, db *gorm.DB, file models.File) (models.FileVersion, bool) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version number"})
+		return models.FileVersion{}, false
+	}
+
+	var version models.FileVersion
+	if err := db.Where("file_id = ? AND version = ?", file.ID, number).First(&version).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return models.FileVersion{}, false
+	}
+	return version, true
+}
+
+// pinnedVersions returns the version numbers of a file that access links are pinned to
+func pinnedVersions(db *gorm.DB, fileID uint) (map[int]bool, error) {
+	var numbers []int
+	if err := db.Model(&models.Access{}).Where("file_id = ? AND version > 0", fileID).Pluck("version", &numbers).Error; err != nil {
+		return nil, err
+	}
+
+	pinned := make(map[int]bool, len(numbers))
+	for _, number := range numbers {
+		pinned[number] = true
+	}
+	return pinned, nil
+}
+
+// ListVersions returns the version history of a file, newest first
+func (fc *FileController) ListVersions(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	var versions []models.FileVersion
+	if err := fc.DB.Where("file_id = ?", file.ID).Order("version DESC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current_version": file.Version,
+		"versions":        versions,
+	})
+}
+
+// DownloadVersion serves the content of a specific version to the file's owner
+func (fc *FileController) DownloadVersion(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	version, ok := findFileVersion(c, fc.DB, file)
+	if !ok {
+		return
+	}
+
+	serveObject(c, fc.Blobs.Backend, version.Location, file.Name, version.ETag(), version.CreatedAt)
+}
+
+// RestoreVersion makes the content of an older version current again by adding it as a new version
+func (fc *FileController) RestoreVersion(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	version, ok := findFileVersion(c, fc.DB, file)
+	if !ok {
+		return
+	}
+
+	if version.Version == file.Version {
+		c.JSON(http.StatusConflict, gin.H{"error": "This version is already the current version"})
+		return
+	}
+	if version.Hash == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "This version cannot be restored because its content is not deduplicated"})
+		return
+	}
+
+	var user models.User
+	if err := fc.DB.First(&user, file.UserID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user information"})
+		return
+	}
+
+	// The restored copy counts towards the storage limit like any other version
+	if !checkUploadLimits(c, fc.DB, user, version.Size, false) {
+		return
+	}
+
+	if err := fc.Blobs.Retain(c.Request.Context(), version.Hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	var restored models.File
+	err := fc.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		restored, err = addVersion(tx, file.ID, version.Size, version.Hash, version.Location)
+		return err
+	})
+	if err != nil {
+		fc.Blobs.Release(c.Request.Context(), version.Hash)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Version restored successfully",
+		"restored_from": version.Version,
+		"file":          restored,
+	})
+}
+
+// DeleteVersion removes a single old version of a file
+func (fc *FileController) DeleteVersion(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	version, ok := findFileVersion(c, fc.DB, file)
+	if !ok {
+		return
+	}
+
+	if version.Version == file.Version {
+		c.JSON(http.StatusConflict, gin.H{"error": "The current version cannot be deleted"})
+		return
+	}
+
+	pinned, err := pinnedVersions(fc.DB, file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access links"})
+		return
+	}
+	if pinned[version.Version] {
+		c.JSON(http.StatusConflict, gin.H{"error": "This version is pinned by an access link"})
+		return
+	}
+
+	if err := fc.DB.Delete(&version).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
+		return
+	}
+	if err := releaseContent(c.Request.Context(), fc.Blobs, version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version content"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Version deleted successfully"})
+}
+
+// PruneVersions deletes all but the newest versions of a file. The current
+// version and versions pinned by access links are always kept.
+func (fc *FileController) PruneVersions(c *gin.Context) {
+	file, ok := findUserFile(c, fc.DB)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Keep int `json:"keep"` // Number of newest versions to keep
+	}
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if requestBody.Keep < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep must be at least 1"})
+		return
+	}
+
+	pinned, err := pinnedVersions(fc.DB, file.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access links"})
+		return
+	}
+
+	var versions []models.FileVersion
+	if err := fc.DB.Where("file_id = ?", file.ID).Order("version DESC").Offset(requestBody.Keep).Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve versions"})
+		return
+	}
+
+	deleted := []int{}
+	var freed int64
+	for _, version := range versions {
+		if version.Version == file.Version || pinned[version.Version] {
+			continue
+		}
+		if err := fc.DB.Delete(&version).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
+			return
+		}
+		if err := releaseContent(c.Request.Context(), fc.Blobs, version); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version content"})
+			return
+		}
+		deleted = append(deleted, version.Version)
+		freed += version.Size
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Versions pruned successfully",
+		"deleted_versions": deleted,
+		"freed_storage":    freed,
+	})
+}
@@ -0,0 +1,307 @@
+package controllers
+
+import (
+	"defdrive/models"
+	"defdrive/webhook"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// WebhookSecretPrefix marks webhook signing secrets
+const WebhookSecretPrefix = "whsec_"
+
+// maxWebhooksPerUser bounds the number of endpoints a user can register
+const maxWebhooksPerUser = 20
+
+type WebhookController struct {
+	DB    *gorm.DB
+	Hooks *webhook.Dispatcher
+}
+
+// NewWebhookController creates a new webhook controller
+func NewWebhookController(db *gorm.DB, hooks *webhook.Dispatcher) *WebhookController {
+	return &WebhookController{DB: db, Hooks: hooks}
+}
+
+// webhookRequest is the body of webhook creation and update requests
+type webhookRequest struct {
+	URL          string   `json:"url" binding:"required"`
+	Description  string   `json:"description"`
+	Events       []string `json:"events" binding:"required"`
+	Active       *bool    `json:"active"`       // Omit to keep the current state
+	RotateSecret bool     `json:"rotateSecret"` // Updates only: replace the signing secret
+}
+
+// validate checks the URL and events of a webhook request, writing the error response on failure
+func (r webhookRequest) validate(c *gin.Context) bool {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook URL must be an absolute http or https URL"})
+		return false
+	}
+
+	if len(r.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event is required", "events": models.WebhookEvents})
+		return false
+	}
+	for _, event := range r.Events {
+		if !models.ValidWebhookEvent(event) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + event, "events": models.WebhookEvents})
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookSecret generates a signing secret for a webhook
+func newWebhookSecret() (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return WebhookSecretPrefix + secret, nil
+}
+
+// CreateWebhook registers a webhook endpoint. The signing secret is only
+// returned in this response.
+func (wc *WebhookController) CreateWebhook(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var requestBody webhookRequest
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !requestBody.validate(c) {
+		return
+	}
+
+	var count int64
+	if err := wc.DB.Model(&models.Webhook{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check webhooks"})
+		return
+	}
+	if count >= maxWebhooksPerUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Webhook limit reached", "limit": maxWebhooksPerUser})
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		return
+	}
+
+	hook := models.Webhook{
+		URL:         requestBody.URL,
+		Description: strings.TrimSpace(requestBody.Description),
+		Secret:      secret,
+		Events:      requestBody.Events,
+		Active:      true,
+		UserID:      userID.(uint),
+	}
+	if err := wc.DB.Create(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook created successfully. Store the secret now, it will not be shown again.",
+		"webhook": hook,
+		"secret":  secret,
+	})
+}
+
+// ListWebhooks returns the current user's webhooks
+func (wc *WebhookController) ListWebhooks(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var hooks []models.Webhook
+	if err := wc.DB.Where("user_id = ?", userID).Order("id").Find(&hooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": hooks, "events": models.WebhookEvents})
+}
+
+// UpdateWebhook changes the URL, events or state of a webhook, optionally rotating its secret
+func (wc *WebhookController) UpdateWebhook(c *gin.Context) {
+	hook, ok := wc.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	var requestBody webhookRequest
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !requestBody.validate(c) {
+		return
+	}
+
+	hook.URL = requestBody.URL
+	hook.Description = strings.TrimSpace(requestBody.Description)
+	hook.Events = requestBody.Events
+	if requestBody.Active != nil {
+		hook.Active = *requestBody.Active
+	}
+
+	response := gin.H{"message": "Webhook updated successfully"}
+	if requestBody.RotateSecret {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+			return
+		}
+		hook.Secret = secret
+		response["secret"] = secret
+	}
+
+	if err := wc.DB.Save(&hook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+
+	response["webhook"] = hook
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteWebhook removes a webhook together with its delivery log
+func (wc *WebhookController) DeleteWebhook(c *gin.Context) {
+	hook, ok := wc.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	err := wc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&hook).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// PingWebhook queues a test delivery to a webhook
+func (wc *WebhookController) PingWebhook(c *gin.Context) {
+	hook, ok := wc.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	delivery, err := wc.Hooks.Ping(hook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue test delivery"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Test delivery queued",
+		"delivery": delivery,
+	})
+}
+
+// ListDeliveries returns the delivery log of a webhook, newest first, with
+// ?page=&per_page= pagination and an optional ?status= filter
+func (wc *WebhookController) ListDeliveries(c *gin.Context) {
+	hook, ok := wc.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	page, perPage, ok := pagination(c)
+	if !ok {
+		return
+	}
+
+	query := wc.DB.Model(&models.WebhookDelivery{}).Where("webhook_id = ?", hook.ID)
+	if status := c.Query("status"); status != "" {
+		if status != models.DeliveryPending && status != models.DeliverySucceeded && status != models.DeliveryFailed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deliveries"})
+		return
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Offset((page - 1) * perPage).Limit(perPage).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries": deliveries,
+		"page":       page,
+		"per_page":   perPage,
+		"total":      total,
+	})
+}
+
+// Redeliver queues a finished delivery to be sent again
+func (wc *WebhookController) Redeliver(c *gin.Context) {
+	hook, ok := wc.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	var delivery models.WebhookDelivery
+	if err := wc.DB.Where("id = ? AND webhook_id = ?", c.Param("deliveryID"), hook.ID).First(&delivery).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+	if delivery.Status == models.DeliveryPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Delivery is still pending"})
+		return
+	}
+
+	if err := wc.Hooks.Redeliver(&delivery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue delivery"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Delivery queued",
+		"delivery": delivery,
+	})
+}
+
+// findWebhook loads the webhook named in the URL if it belongs to the current user
+func (wc *WebhookController) findWebhook(c *gin.Context) (models.Webhook, bool) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return models.Webhook{}, false
+	}
+
+	var hook models.Webhook
+	if err := wc.DB.Where("id = ? AND user_id = ?", c.Param("webhookID"), userID).First(&hook).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return models.Webhook{}, false
+	}
+	return hook, true
+}
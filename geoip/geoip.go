@@ -0,0 +1,121 @@
+// Package geoip resolves client IP addresses to their country and autonomous
+// system using locally stored MaxMind-format (.mmdb) databases, such as
+// GeoLite2-Country and GeoLite2-ASN. No lookups leave the server.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrUnavailable is returned for lookups in a database that is not configured
+var ErrUnavailable = errors.New("geoip: database not configured")
+
+// countryRecord holds the fields read from country and city databases
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// asnRecord holds the fields read from ASN databases
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// Resolver looks up IP addresses in a country database, an ASN database or both
+type Resolver struct {
+	countries *maxminddb.Reader
+	asns      *maxminddb.Reader
+}
+
+// NewFromEnv opens the databases at GEOIP_COUNTRY_DB and GEOIP_ASN_DB. It
+// returns nil without an error if neither is set.
+func NewFromEnv() (*Resolver, error) {
+	return Open(strings.TrimSpace(os.Getenv("GEOIP_COUNTRY_DB")), strings.TrimSpace(os.Getenv("GEOIP_ASN_DB")))
+}
+
+// Open opens a country database and an ASN database; either path may be empty.
+// It returns nil without an error if both are.
+func Open(countryPath, asnPath string) (*Resolver, error) {
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+
+	r := &Resolver{}
+	var err error
+	if countryPath != "" {
+		if r.countries, err = maxminddb.Open(countryPath); err != nil {
+			return nil, fmt.Errorf("geoip: failed to open country database: %w", err)
+		}
+	}
+	if asnPath != "" {
+		if r.asns, err = maxminddb.Open(asnPath); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("geoip: failed to open ASN database: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// Close releases the databases
+func (r *Resolver) Close() error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	if r.countries != nil {
+		errs = append(errs, r.countries.Close())
+	}
+	if r.asns != nil {
+		errs = append(errs, r.asns.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// HasCountries reports whether a country database is configured
+func (r *Resolver) HasCountries() bool {
+	return r != nil && r.countries != nil
+}
+
+// HasASNs reports whether an ASN database is configured
+func (r *Resolver) HasASNs() bool {
+	return r != nil && r.asns != nil
+}
+
+// Country returns the ISO code of the country an IP address is located in,
+// falling back to the country it is registered in, or "" if it is unknown
+func (r *Resolver) Country(ip net.IP) (string, error) {
+	if !r.HasCountries() {
+		return "", ErrUnavailable
+	}
+	var record countryRecord
+	if err := r.countries.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return strings.ToUpper(record.Country.ISOCode), nil
+	}
+	return strings.ToUpper(record.RegisteredCountry.ISOCode), nil
+}
+
+// ASN returns the number of the autonomous system an IP address belongs to,
+// or 0 if it is unknown
+func (r *Resolver) ASN(ip net.IP) (uint, error) {
+	if !r.HasASNs() {
+		return 0, ErrUnavailable
+	}
+	var record asnRecord
+	if err := r.asns.Lookup(ip, &record); err != nil {
+		return 0, err
+	}
+	return record.Number, nil
+}
@@ -0,0 +1,135 @@
+// Package ipfilter parses the address lists of access links, holding single
+// addresses, ranges such as "10.0.0.1-10.0.0.99" and CIDR subnets, and
+// matches client addresses against them.
+package ipfilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Rule matches an address, an inclusive range of addresses or a subnet
+type Rule struct {
+	From, To netip.Addr
+	Prefix   netip.Prefix // Set for subnets
+}
+
+// ParseAddress parses a single address or a range of addresses of the same family
+func ParseAddress(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		first, err := parseAddr(from)
+		if err != nil {
+			return Rule{}, err
+		}
+		last, err := parseAddr(to)
+		if err != nil {
+			return Rule{}, err
+		}
+		if first.Is4() != last.Is4() {
+			return Rule{}, fmt.Errorf("range %q mixes IPv4 and IPv6", s)
+		}
+		if last.Less(first) {
+			return Rule{}, fmt.Errorf("range %q ends before it starts", s)
+		}
+		return Rule{From: first, To: last}, nil
+	}
+
+	addr, err := parseAddr(s)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{From: addr, To: addr}, nil
+}
+
+// ParseSubnet parses a subnet in CIDR notation. Host bits are ignored, so
+// "192.168.1.7/24" is 192.168.1.0/24.
+func ParseSubnet(s string) (Rule, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid subnet %q, expected CIDR notation such as 192.168.1.0/24", s)
+	}
+	if prefix.Addr().Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return Rule{}, fmt.Errorf("invalid subnet %q, IPv4-mapped prefixes must be at least /96", s)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+	}
+	prefix = prefix.Masked()
+	return Rule{From: prefix.Addr(), To: lastAddr(prefix), Prefix: prefix}, nil
+}
+
+// Contains reports whether the rule matches addr
+func (r Rule) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.Is4() == r.From.Is4() && !addr.Less(r.From) && !r.To.Less(addr)
+}
+
+// String returns the canonical form of the rule
+func (r Rule) String() string {
+	switch {
+	case r.Prefix.IsValid():
+		return r.Prefix.String()
+	case r.From == r.To:
+		return r.From.String()
+	default:
+		return r.From.String() + "-" + r.To.String()
+	}
+}
+
+// List is a list of rules matching an address if any of them does
+type List []Rule
+
+// ParseList parses every entry with parse, returning the first error
+func ParseList(entries []string, parse func(string) (Rule, error)) (List, error) {
+	list := make(List, 0, len(entries))
+	for _, entry := range entries {
+		rule, err := parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+// Contains reports whether any rule of the list matches addr
+func (l List) Contains(addr netip.Addr) bool {
+	for _, rule := range l {
+		if rule.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns the canonical form of every rule
+func (l List) Strings() []string {
+	entries := make([]string, len(l))
+	for i, rule := range l {
+		entries[i] = rule.String()
+	}
+	return entries
+}
+
+// parseAddr parses an address without a zone, unmapping IPv4-mapped IPv6 addresses
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return addr.Unmap(), nil
+}
+
+// lastAddr returns the last address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
@@ -0,0 +1,84 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"defdrive/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DatabaseStore keeps failure counters in the login_failures table, so that
+// every replica sees the same counters
+type DatabaseStore struct {
+	DB *gorm.DB
+}
+
+// NewDatabaseStore creates a store on top of db
+func NewDatabaseStore(db *gorm.DB) *DatabaseStore {
+	return &DatabaseStore{DB: db}
+}
+
+func toState(row models.LoginFailure) State {
+	return State{Key: row.Key, Failures: row.Failures, LastFailure: row.LastFailure, LockedUntil: row.LockedUntil}
+}
+
+func (d *DatabaseStore) Get(ctx context.Context, key string) (State, error) {
+	var row models.LoginFailure
+	err := d.DB.WithContext(ctx).First(&row, "key = ?", key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	return toState(row), nil
+}
+
+func (d *DatabaseStore) Update(ctx context.Context, key string, fn func(State) State) (State, error) {
+	var state State
+	err := d.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then lock it so concurrent updates are all applied
+		row := models.LoginFailure{Key: key}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&row, "key = ?", key).Error; err != nil {
+			return err
+		}
+
+		state = fn(toState(row))
+		return tx.Model(&row).Updates(map[string]interface{}{
+			"failures":     state.Failures,
+			"last_failure": state.LastFailure,
+			"locked_until": state.LockedUntil,
+		}).Error
+	})
+	return state, err
+}
+
+func (d *DatabaseStore) Reset(ctx context.Context, key string) error {
+	return d.DB.WithContext(ctx).Where("key = ?", key).Delete(&models.LoginFailure{}).Error
+}
+
+func (d *DatabaseStore) List(ctx context.Context) ([]State, error) {
+	var rows []models.LoginFailure
+	if err := d.DB.WithContext(ctx).Where("failures > 0").Order("last_failure DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	states := make([]State, 0, len(rows))
+	for _, row := range rows {
+		states = append(states, toState(row))
+	}
+	return states, nil
+}
+
+func (d *DatabaseStore) Prune(ctx context.Context, cutoff time.Time) error {
+	return d.DB.WithContext(ctx).
+		Where("last_failure < ? AND locked_until < ?", cutoff, time.Now()).
+		Delete(&models.LoginFailure{}).Error
+}
@@ -0,0 +1,326 @@
+package lockout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// State is the failure history of one key, such as a username or an IP address
+type State struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time // Zero if the key is not blocked
+}
+
+// Store keeps failure counters. MemoryStore works within one process;
+// DatabaseStore shares the counters between replicas.
+type Store interface {
+	// Get returns the state of key, or a zero State if it has none
+	Get(ctx context.Context, key string) (State, error)
+
+	// Update atomically replaces the state of key with fn applied to it
+	Update(ctx context.Context, key string, fn func(State) State) (State, error)
+
+	// Reset clears the state of key
+	Reset(ctx context.Context, key string) error
+
+	// List returns every key that has failures
+	List(ctx context.Context) ([]State, error)
+
+	// Prune removes states whose last failure was before cutoff and that are no longer blocked
+	Prune(ctx context.Context, cutoff time.Time) error
+}
+
+// Policy decides how long a key is blocked after a number of failures
+type Policy struct {
+	MaxFailures int           // Failures after which the key is locked out
+	BaseDelay   time.Duration // Delay after the first failure, doubled with every further one
+	Lockout     time.Duration // How long a key is locked out after MaxFailures
+	Window      time.Duration // Failures older than this are forgotten
+}
+
+// reserve counts an attempt at now as a failure until it is known to have
+// succeeded, unless the key is blocked. Reaching MaxFailures locks the key
+// out right away, so concurrent attempts cannot exceed the limit.
+func (p Policy) reserve(state State, now time.Time) (State, bool) {
+	if state.LockedUntil.After(now) {
+		return state, false
+	}
+	if now.Sub(state.LastFailure) > p.Window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailure = now
+	if state.Failures >= p.MaxFailures {
+		state.LockedUntil = now.Add(p.Lockout)
+	}
+	return state, true
+}
+
+// fail blocks the key after a reserved attempt turned out to be a failure
+func (p Policy) fail(state State, now time.Time) State {
+	if until := p.BlockedUntil(max(state.Failures, 1), now); until.After(state.LockedUntil) {
+		state.LockedUntil = until
+	}
+	return state
+}
+
+// count records a failure at now without checking whether the key is blocked
+func (p Policy) count(state State, now time.Time) State {
+	if now.Sub(state.LastFailure) > p.Window {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailure = now
+	return p.fail(state, now)
+}
+
+// release takes back a reservation that turned state before into after,
+// restoring the failure time and block unless other attempts changed them since
+func release(state, before, after State) State {
+	if state.Failures > 0 {
+		state.Failures--
+	}
+	if state.LastFailure.Equal(after.LastFailure) {
+		state.LastFailure = before.LastFailure
+	}
+	if state.LockedUntil.Equal(after.LockedUntil) {
+		state.LockedUntil = before.LockedUntil
+	}
+	return state
+}
+
+// BlockedUntil returns until when a key with this many failures is blocked
+func (p Policy) BlockedUntil(failures int, now time.Time) time.Time {
+	if failures >= p.MaxFailures {
+		return now.Add(p.Lockout)
+	}
+
+	delay := p.BaseDelay << (failures - 1)
+	if delay <= 0 || delay > p.Lockout {
+		delay = p.Lockout
+	}
+	return now.Add(delay)
+}
+
+// Limiter throttles login attempts per username and per client IP
+type Limiter struct {
+	Store Store
+	User  Policy
+	IP    Policy
+}
+
+// Attempt is a key an attempt is counted for and the policy applied to it
+type Attempt struct {
+	Key       string
+	Policy    Policy
+	CountOnly bool // Only counted if the attempt fails, never blocks it
+}
+
+// Reservation is an attempt counted by Reserve before it is known whether it
+// succeeds. It must be settled with Fail or Release.
+type Reservation struct {
+	attempts []Attempt
+	reserved []reservedKey
+}
+
+// reservedKey is the state of a key before and after it was reserved
+type reservedKey struct {
+	key           string
+	before, after State
+}
+
+// NewFromEnv creates a limiter with the store selected by LOCKOUT_STORE
+// (memory or database) and policies read from the environment
+func NewFromEnv(db *gorm.DB) (*Limiter, error) {
+	var store Store
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOCKOUT_STORE"))) {
+	case "", "memory":
+		store = NewMemoryStore()
+	case "database", "db":
+		store = NewDatabaseStore(db)
+	default:
+		return nil, fmt.Errorf("lockout: unknown LOCKOUT_STORE %q", os.Getenv("LOCKOUT_STORE"))
+	}
+
+	baseDelay := getDuration("LOGIN_BACKOFF_BASE", time.Second)
+	lockout := getDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	window := getDuration("LOGIN_FAILURE_WINDOW", time.Hour)
+
+	return &Limiter{
+		Store: store,
+		User:  Policy{MaxFailures: getInt("LOGIN_MAX_FAILURES", 5), BaseDelay: baseDelay, Lockout: lockout, Window: window},
+		IP:    Policy{MaxFailures: getInt("LOGIN_IP_MAX_FAILURES", 20), BaseDelay: baseDelay, Lockout: lockout, Window: window},
+	}, nil
+}
+
+// UserKey returns the store key for a username
+func UserKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// IPKey returns the store key for a client IP address
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// ChallengeKey returns the store key for a two-factor challenge token
+func ChallengeKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "challenge:" + hex.EncodeToString(sum[:16])
+}
+
+// LinkKey returns the store key for password attempts on an access link from a client IP
+func LinkKey(accessID uint, ip string) string {
+	return fmt.Sprintf("link:%d:%s", accessID, ip)
+}
+
+// LoginAttempts returns the keys a password login for username from ip is counted for
+func (l *Limiter) LoginAttempts(username, ip string) []Attempt {
+	return []Attempt{{Key: UserKey(username), Policy: l.User}, {Key: IPKey(ip), Policy: l.IP}}
+}
+
+// ChallengeAttempts returns the keys a two-factor code for a challenge token
+// is counted for. The password was already accepted, so the username does not
+// block the attempt, but failed codes still count towards it.
+func (l *Limiter) ChallengeAttempts(token, username, ip string) []Attempt {
+	return []Attempt{
+		{Key: ChallengeKey(token), Policy: l.User},
+		{Key: IPKey(ip), Policy: l.IP},
+		{Key: UserKey(username), Policy: l.User, CountOnly: true},
+	}
+}
+
+// LinkAttempts returns the keys a password attempt on an access link from ip is counted for
+func (l *Limiter) LinkAttempts(accessID uint, ip string) []Attempt {
+	return []Attempt{{Key: LinkKey(accessID, ip), Policy: l.User}}
+}
+
+// Reserve counts an attempt for every key before the credentials are
+// verified, so that concurrent attempts cannot get past the limits. If any key
+// is blocked, nothing is counted and the wait until it is free is returned.
+func (l *Limiter) Reserve(ctx context.Context, attempts []Attempt) (*Reservation, time.Duration, error) {
+	now := time.Now()
+	r := &Reservation{attempts: attempts}
+
+	for _, attempt := range attempts {
+		if attempt.CountOnly {
+			continue
+		}
+
+		allowed := false
+		var before State
+		after, err := l.Store.Update(ctx, attempt.Key, func(state State) State {
+			before = state
+			state, allowed = attempt.Policy.reserve(state, now)
+			return state
+		})
+		if err == nil && allowed {
+			r.reserved = append(r.reserved, reservedKey{key: attempt.Key, before: before, after: after})
+			continue
+		}
+
+		// Give back the attempts already counted for the other keys
+		l.Release(ctx, r)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, after.LockedUntil.Sub(now), nil
+	}
+	return r, 0, nil
+}
+
+// Fail settles a reserved attempt that failed and returns how long the caller
+// has to wait before trying again
+func (l *Limiter) Fail(ctx context.Context, r *Reservation) (time.Duration, error) {
+	if r == nil {
+		return 0, nil
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, attempt := range r.attempts {
+		policy := attempt.Policy
+		fn := func(state State) State { return policy.fail(state, now) }
+		if attempt.CountOnly {
+			fn = func(state State) State { return policy.count(state, now) }
+		}
+
+		state, err := l.Store.Update(ctx, attempt.Key, fn)
+		if err != nil {
+			return 0, err
+		}
+		if d := state.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// Release takes back a reserved attempt once it turned out to be valid,
+// leaving every key as it was before the attempt
+func (l *Limiter) Release(ctx context.Context, r *Reservation) error {
+	if r == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, key := range r.reserved {
+		_, err := l.Store.Update(ctx, key.key, func(state State) State {
+			return release(state, key.before, key.after)
+		})
+		errs = append(errs, err)
+	}
+	r.reserved = nil
+	return errors.Join(errs...)
+}
+
+// Succeed clears the failures of username after a successful login. The
+// counter of the IP is kept, so that an attacker cannot reset it by logging
+// into their own account.
+func (l *Limiter) Succeed(ctx context.Context, username string) error {
+	return l.Store.Reset(ctx, UserKey(username))
+}
+
+// RunPruner periodically removes stale failure counters until ctx is cancelled
+func (l *Limiter) RunPruner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			window := l.User.Window
+			if l.IP.Window > window {
+				window = l.IP.Window
+			}
+			l.Store.Prune(ctx, time.Now().Add(-window))
+		}
+	}
+}
+
+func getInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func getDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
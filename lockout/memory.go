@@ -0,0 +1,68 @@
+package lockout
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps failure counters in process memory
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// NewMemoryStore creates an empty in-process store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]State)}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.states[key], nil
+}
+
+func (m *MemoryStore) Update(ctx context.Context, key string, fn func(State) State) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.states[key]
+	state.Key = key
+	state = fn(state)
+	m.states[key] = state
+	return state, nil
+}
+
+func (m *MemoryStore) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, key)
+	return nil
+}
+
+func (m *MemoryStore) List(ctx context.Context) ([]State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]State, 0, len(m.states))
+	for _, state := range m.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].LastFailure.After(states[j].LastFailure) })
+	return states, nil
+}
+
+func (m *MemoryStore) Prune(ctx context.Context, cutoff time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, state := range m.states {
+		if state.LastFailure.Before(cutoff) && state.LockedUntil.Before(now) {
+			delete(m.states, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer is implemented by every mail driver
+type Mailer interface {
+	// Send delivers msg or returns an error if it could not be handed off
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewFromEnv creates the mailer selected by the MAILER environment variable
+func NewFromEnv() (Mailer, error) {
+	mailerType := strings.ToLower(strings.TrimSpace(os.Getenv("MAILER")))
+
+	switch mailerType {
+	case "", "log":
+		return NewLog(), nil
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTP(SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		})
+	default:
+		return nil, fmt.Errorf("mailer: unknown MAILER %q", mailerType)
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"defdrive/clientip"
+	"defdrive/controllers"
+	"defdrive/geoip"
+	"defdrive/lockout"
+	"defdrive/mailer"
 	// "defdrive/middleware"
 	"defdrive/models"
 	"defdrive/routes"
+	"defdrive/storage"
+	"defdrive/webhook"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -49,16 +58,71 @@ func main() {
 		log.Fatalf("Failed to connect to database after %d attempts: %v", maxRetries, err)
 	}
 
-	// Ensure the tables are created in the correct order
-	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.Access{})
+	// Create or update the tables and backfill new columns
+	err = models.Migrate(db)
 	if err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	log.Println("Database initialized successfully")
 
+	// Give the users listed in ADMIN_USERNAMES the admin role
+	if err := models.PromoteAdmins(db, controllers.AdminUsernames()); err != nil {
+		log.Fatalf("Failed to bootstrap administrators: %v", err)
+	}
+
+	// Set up the storage backend selected by STORAGE_TYPE
+	store, err := storage.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	// Uploaded contents are deduplicated by hash on top of the storage backend
+	blobs := storage.NewBlobs(store, db)
+
+	// Move files uploaded before deduplication into content-addressed storage
+	if err := blobs.MigrateLegacyFiles(context.Background()); err != nil {
+		log.Printf("Warning: Failed to migrate legacy files: %v", err)
+	}
+
+	// Permanently delete files that have been in the trash longer than TRASH_RETENTION
+	go controllers.RunTrashPurger(context.Background(), db, blobs)
+
+	// Discard resumable uploads that received no data for UPLOAD_EXPIRATION
+	go controllers.RunUploadPurger(context.Background(), db, blobs)
+
+	// Set up the mailer selected by MAILER
+	mail, err := mailer.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Set up login throttling with the store selected by LOCKOUT_STORE
+	limiter, err := lockout.NewFromEnv(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize login lockout: %v", err)
+	}
+	go limiter.RunPruner(context.Background(), 10*time.Minute)
+
+	// Deliver file and link events to the webhooks registered by users
+	hooks := webhook.NewFromEnv(db)
+	go hooks.Run(context.Background())
+
+	// Open the GeoIP databases used for country restrictions, if configured
+	geo, err := geoip.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+	defer geo.Close()
+
+	// Only trust the client addresses forwarded by the proxies in TRUSTED_PROXIES
+	proxies, err := clientip.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure trusted proxies: %v", err)
+	}
+
 	// Set up router
-	router := routes.SetupRouter(db)
+	router := routes.SetupRouter(db, blobs, mail, limiter, hooks, geo, proxies)
 
 	// // Configure CORS
 	// router.Use(cors.New(cors.Config{
@@ -76,8 +140,13 @@ func main() {
 	}
 
 	// Start the server
+	listener, err := proxies.Listen(":" + port)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	server := &http.Server{Handler: router, ConnContext: clientip.ConnContext}
 	log.Printf("Server starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
+	if err := server.Serve(listener); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"defdrive/models"
+	"defdrive/webhook"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	denyReasonKey = "accessDenyReason"
+	downloadKey   = "accessDownload"
+
+	// maxEventHeaderLength bounds the user agent and referer stored per event
+	maxEventHeaderLength = 512
+)
+
+// denyAccess rejects a request for an access link, remembering the reason for the access log
+func denyAccess(c *gin.Context, status int, reason string, body gin.H) {
+	c.Set(denyReasonKey, reason)
+	c.JSON(status, body)
+	c.Abort()
+}
+
+// recordAccessEvent adds the outcome of a request for an access link to its
+// access log and notifies the file owner's webhooks of allowed and denied requests
+func recordAccessEvent(c *gin.Context, db *gorm.DB, hooks *webhook.Dispatcher, access models.Access, file *models.File, start time.Time) {
+	status := c.Writer.Status()
+	event := models.AccessEvent{
+		AccessID:   access.ID,
+		CreatedAt:  start,
+		ClientIP:   c.ClientIP(),
+		UserAgent:  truncate(c.Request.UserAgent(), maxEventHeaderLength),
+		Referer:    truncate(c.Request.Referer(), maxEventHeaderLength),
+		Method:     c.Request.Method,
+		Status:     status,
+		Outcome:    models.EventAllowed,
+		Download:   c.GetBool(downloadKey),
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if size := c.Writer.Size(); size > 0 {
+		event.BytesServed = int64(size)
+	}
+
+	switch reason := c.GetString(denyReasonKey); {
+	case reason != "":
+		event.Outcome = models.EventDenied
+		event.Reason = reason
+	case status >= http.StatusBadRequest:
+		event.Outcome = models.EventError
+	}
+
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to record access event for access %d: %v", access.ID, err)
+	}
+
+	// The owner is unknown if the file could not be loaded
+	if file.ID == 0 || event.Outcome == models.EventError {
+		return
+	}
+	name := models.EventLinkAccessed
+	if event.Outcome == models.EventDenied {
+		name = models.EventLinkDenied
+	}
+	hooks.Enqueue(file.UserID, name, gin.H{
+		"access_id":   access.ID,
+		"access_name": access.Name,
+		"file_id":     file.ID,
+		"file_name":   file.Name,
+		"request":     event,
+	})
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -1,18 +1,29 @@
 package middleware
 
 import (
+	"defdrive/clientip"
+	"defdrive/geoip"
+	"defdrive/ipfilter"
+	"defdrive/lockout"
 	"defdrive/models"
-	"net"
+	"defdrive/webhook"
+	"errors"
+	"log"
+	"math"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-// AccessRestrictions middleware to handle link expiration, one-time use, subnet restriction, public IP restriction, and TTL
-func AccessRestrictions(db *gorm.DB) gin.HandlerFunc {
+// AccessRestrictions middleware to handle link expiration, download limits, subnet restriction, public IP restriction, country restriction and passwords
+func AccessRestrictions(db *gorm.DB, hooks *webhook.Dispatcher, geo *geoip.Resolver, limiter *lockout.Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		start := time.Now()
 		link := c.Param("link")
 		if link == "" {
 			link = c.Param("hash")
@@ -25,33 +36,61 @@ func AccessRestrictions(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// Check if the access corresponds to a file
+		// Every request for an existing link is recorded in its access log once it is answered
 		var file models.File
+		defer recordAccessEvent(c, db, hooks, access, &file, start)
+
+		// Check if the access corresponds to a file
 		if err := db.Where("id = ?", access.FileID).First(&file).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-			c.Abort()
+			denyAccess(c, http.StatusNotFound, models.DenyFileNotFound, gin.H{"error": "File not found"})
 			return
 		}
 
 		// Return an error if neither the file nor the access is public
 		if !(file.Public && access.Public) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied: file or access is not public"})
-			c.Abort()
+			denyAccess(c, http.StatusForbidden, models.DenyNotPublic, gin.H{"error": "Access denied: file or access is not public"})
 			return
 		}
 
-		// Check subnet, IP, one-time use, and TTL restrictions
-		if !checkSubnetRestriction(access, c) ||
+		// Check blocked addresses, subnet, IP, country, expiration, schedule, password and data transfer restrictions
+		if !checkDenyList(access, c) ||
+			!checkSubnetRestriction(access, c) ||
 			!checkIPRestriction(access, c) ||
-			!checkOneTimeUse(access, c) ||
-			!checkTTL(access, db, c) ||
-			!checkExpiration(access, c) {
+			!checkGeoRestriction(access, geo, c) ||
+			!checkExpiration(access, c) ||
+			!checkSchedule(access, c) ||
+			!checkPassword(access, limiter, c) ||
+			!checkDataCap(access, c) {
 			return
 		}
 
-		if access.OneTimeUse {
-			access.Used = true
-			db.Save(&access)
+		// Resolve the content served by the link (a pinned version or the current one)
+		version, err := models.ServedVersion(db, access, file)
+		if err != nil {
+			denyAccess(c, http.StatusNotFound, models.DenyVersionNotFound, gin.H{"error": "File version not found"})
+			return
+		}
+
+		// Reserve the bytes of the response up front and give back what was not
+		// sent once the handler is done, even if the client disconnected
+		reserved, ok := reserveBytes(c, db, access, version)
+		if !ok {
+			return
+		}
+		defer settleBytes(c, db, access, reserved)
+
+		// Revalidating or resuming a download that was already granted does not use up the link
+		claim, counts := countsAsDownload(c, db, access, version)
+		if counts {
+			if !redeemDownload(access, db, c) {
+				return
+			}
+			c.Set(downloadKey, true)
+
+			claim = recordDownloadSession(c, db, access, version)
+		}
+		if claim != nil {
+			defer claim.settle(c, db)
 		}
 
 		c.Next()
@@ -59,66 +98,219 @@ func AccessRestrictions(db *gorm.DB) gin.HandlerFunc {
 }
 
 func checkExpiration(access models.Access, c *gin.Context) bool {
-	if access.Expires != "" {
-		expiryTime, err := time.Parse(time.RFC3339, access.Expires)
-		if err != nil || time.Now().After(expiryTime) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access link has expired"})
-			c.Abort()
-			return false
-		}
+	now := time.Now()
+	if access.NotBefore != nil && now.Before(*access.NotBefore) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(access.NotBefore.Sub(now).Seconds()))))
+		denyAccess(c, http.StatusForbidden, models.DenyNotYetActive, gin.H{"error": "Access link is not active yet", "not_before": access.NotBefore})
+		return false
+	}
+	if access.Expires != nil && !now.Before(*access.Expires) {
+		denyAccess(c, http.StatusForbidden, models.DenyExpired, gin.H{"error": "Access link has expired"})
+		return false
+	}
+	return true
+}
+
+// checkSchedule rejects requests outside the access's recurring time windows,
+// telling the client when the link opens next
+func checkSchedule(access models.Access, c *gin.Context) bool {
+	now := time.Now()
+	if access.Schedule == nil || access.Schedule.Open(now) {
+		return true
+	}
+
+	body := gin.H{"error": "Access link is not available at this time"}
+	if next, ok := access.Schedule.NextOpen(now); ok && (access.Expires == nil || next.Before(*access.Expires)) {
+		body["next_open"] = next
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(next.Sub(now).Seconds()))))
+	}
+	denyAccess(c, http.StatusForbidden, models.DenyOutsideSchedule, body)
+	return false
+}
+
+// errDataCap ends responses that would exceed the bytes reserved for them
+var errDataCap = errors.New("response exceeds the reserved data transfer")
+
+// checkDataCap rejects requests once the data transfer budget is used up
+func checkDataCap(access models.Access, c *gin.Context) bool {
+	if access.MaxBytes > 0 && access.BytesUsed >= access.MaxBytes {
+		denyAccess(c, http.StatusForbidden, models.DenyDataCap, gin.H{"error": "Access link has reached its data transfer limit"})
+		return false
 	}
 	return true
 }
 
-func checkOneTimeUse(access models.Access, c *gin.Context) bool {
-	if access.OneTimeUse && access.Used {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access link has already been used"})
+// reserveBytes adds the size of the response body to the access's transfer
+// count before it is served. The data cap is checked in the same UPDATE so
+// concurrent downloads cannot go past it together; with a cap, the response
+// is also cut off at the reserved size.
+func reserveBytes(c *gin.Context, db *gorm.DB, access models.Access, version models.FileVersion) (int64, bool) {
+	size := responseSize(c.Request, version)
+	result := db.Model(&models.Access{}).
+		Where("id = ? AND (max_bytes = 0 OR bytes_used + ? <= max_bytes)", access.ID, size).
+		UpdateColumn("bytes_used", gorm.Expr("bytes_used + ?", size))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record data transfer"})
+		c.Abort()
+		return 0, false
+	}
+	if result.RowsAffected == 0 {
+		denyAccess(c, http.StatusForbidden, models.DenyDataCap, gin.H{"error": "Access link has reached its data transfer limit"})
+		return 0, false
+	}
+
+	if access.MaxBytes > 0 {
+		c.Writer = &cappedWriter{ResponseWriter: c.Writer, remaining: size}
+	}
+	return size, true
+}
+
+// settleBytes gives back the reserved bytes a response did not send
+func settleBytes(c *gin.Context, db *gorm.DB, access models.Access, reserved int64) {
+	var sent int64
+	if status := c.Writer.Status(); (status == http.StatusOK || status == http.StatusPartialContent) && c.Writer.Size() > 0 {
+		sent = int64(c.Writer.Size())
+	}
+	if unused := reserved - sent; unused > 0 {
+		db.Model(&models.Access{}).Where("id = ?", access.ID).
+			UpdateColumn("bytes_used", gorm.Expr("bytes_used - ?", unused))
+	}
+}
+
+// responseSize returns how many body bytes serving version for r will take:
+// none for HEAD and 304 responses, the length of a single range, or the whole file
+func responseSize(r *http.Request, version models.FileVersion) int64 {
+	if r.Method == http.MethodHead || isNotModified(r, version.ETag(), version.CreatedAt) {
+		return 0
+	}
+	if start, end, ok := requestedRange(r, version.ETag(), version.CreatedAt, version.Size); ok {
+		return end - start + 1
+	}
+	return version.Size
+}
+
+// cappedWriter stops a response body after the bytes reserved for it, such as
+// multipart range responses that turn out larger than the file
+type cappedWriter struct {
+	gin.ResponseWriter
+	remaining int64
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		n, _ := w.ResponseWriter.Write(p[:w.remaining])
+		w.remaining -= int64(n)
+		return n, errDataCap
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
+
+func (w *cappedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// redeemDownload uses up one of the link's downloads. The limit is checked in the
+// same UPDATE so concurrent requests cannot both redeem the last download.
+func redeemDownload(access models.Access, db *gorm.DB, c *gin.Context) bool {
+	result := db.Model(&models.Access{}).
+		Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", access.ID).
+		UpdateColumn("download_count", gorm.Expr("download_count + 1"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record download"})
 		c.Abort()
 		return false
 	}
+	if result.RowsAffected == 0 {
+		denyAccess(c, http.StatusForbidden, models.DenyDownloadLimit, gin.H{"error": "Access link has reached its download limit"})
+		return false
+	}
+	return true
+}
+
+// checkDenyList rejects clients in the blocked subnets, addresses and ranges of an access
+func checkDenyList(access models.Access, c *gin.Context) bool {
+	ip := clientAddr(c)
+	if listContains(access.DenySubnets, ipfilter.ParseSubnet, ip) || listContains(access.DenyIPs, ipfilter.ParseAddress, ip) {
+		denyAccess(c, http.StatusForbidden, models.DenyBlocked, gin.H{"error": "Access blocked for your network"})
+		return false
+	}
 	return true
 }
 
 func checkSubnetRestriction(access models.Access, c *gin.Context) bool {
-	if len(access.Subnets) > 0 {
-		ip := c.ClientIP()
-		for _, subnet := range access.Subnets {
-			_, parsedSubnet, err := net.ParseCIDR(subnet)
-			if err == nil && parsedSubnet.Contains(net.ParseIP(ip)) {
-				return true
-			}
-		}
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access restricted to specific subnets"})
-		c.Abort()
+	if len(access.Subnets) > 0 && !listContains(access.Subnets, ipfilter.ParseSubnet, clientAddr(c)) {
+		denyAccess(c, http.StatusForbidden, models.DenySubnet, gin.H{"error": "Access restricted to specific subnets"})
 		return false
 	}
 	return true
 }
 
 func checkIPRestriction(access models.Access, c *gin.Context) bool {
-	if len(access.IPs) > 0 {
-		ip := c.ClientIP()
-		for _, allowedIP := range access.IPs {
-			if ip == allowedIP {
-				return true
-			}
-		}
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access restricted to specific IPs"})
-		c.Abort()
+	if len(access.IPs) > 0 && !listContains(access.IPs, ipfilter.ParseAddress, clientAddr(c)) {
+		denyAccess(c, http.StatusForbidden, models.DenyIP, gin.H{"error": "Access restricted to specific IPs"})
 		return false
 	}
 	return true
 }
 
-func checkTTL(access models.Access, db *gorm.DB, c *gin.Context) bool {
-	if access.EnableTTL && access.TTL > 0 {
-		access.TTL--
-		if access.TTL == 0 {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Access link has reached its TTL limit"})
-			c.Abort()
+// clientAddr returns the client's address, or the zero address matching nothing
+func clientAddr(c *gin.Context) netip.Addr {
+	addr, _ := netip.ParseAddr(c.ClientIP())
+	return addr.Unmap()
+}
+
+// listContains reports whether addr matches an entry of an address list.
+// Entries are validated when a link is saved; invalid ones stored before match nothing.
+func listContains(entries []string, parse func(string) (ipfilter.Rule, error), addr netip.Addr) bool {
+	for _, entry := range entries {
+		if rule, err := parse(entry); err == nil && rule.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGeoRestriction enforces the country and autonomous system lists of an
+// access. Clients whose country or ASN is unknown only pass deny lists. Links
+// with such lists are unavailable, rather than open, without the database.
+func checkGeoRestriction(access models.Access, geo *geoip.Resolver, c *gin.Context) bool {
+	countries := len(access.AllowCountries) > 0 || len(access.DenyCountries) > 0
+	asns := len(access.AllowASNs) > 0 || len(access.DenyASNs) > 0
+	if !countries && !asns {
+		return true
+	}
+
+	ip := clientip.ParseIP(c.ClientIP())
+	unavailable := func(err error) bool {
+		log.Printf("GeoIP lookup for access %d failed: %v", access.ID, err)
+		denyAccess(c, http.StatusServiceUnavailable, models.DenyGeoUnavailable, gin.H{"error": "Access link location check is unavailable"})
+		return false
+	}
+
+	if countries {
+		country, err := geo.Country(ip)
+		if err != nil {
+			return unavailable(err)
+		}
+		if (len(access.AllowCountries) > 0 && !slices.Contains(access.AllowCountries, country)) ||
+			(country != "" && slices.Contains(access.DenyCountries, country)) {
+			denyAccess(c, http.StatusForbidden, models.DenyCountry, gin.H{"error": "Access restricted to specific countries"})
+			return false
+		}
+	}
+
+	if asns {
+		asn, err := geo.ASN(ip)
+		if err != nil {
+			return unavailable(err)
+		}
+		if (len(access.AllowASNs) > 0 && !slices.Contains(access.AllowASNs, asn)) ||
+			(asn != 0 && slices.Contains(access.DenyASNs, asn)) {
+			denyAccess(c, http.StatusForbidden, models.DenyASN, gin.H{"error": "Access restricted to specific networks"})
 			return false
 		}
-		db.Save(&access)
 	}
 	return true
 }
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"defdrive/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AdminRequired only lets through users whose role grants at least one
+// permission. The role is loaded from the database on every request, so a
+// demoted user loses access immediately regardless of what their token says.
+// Must run after AuthRequired.
+func AdminRequired(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			c.Abort()
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+			c.Abort()
+			return
+		}
+
+		var role models.Role
+		if err := db.Where("name = ?", user.Role).First(&role).Error; err != nil || len(role.Permissions) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Administrator access required"})
+			c.Abort()
+			return
+		}
+
+		c.Set("role", role)
+		c.Next()
+	}
+}
+
+// RequirePermission rejects requests whose role (set by AdminRequired) lacks permission
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, exists := c.Get("role")
+		if !exists || !role.(models.Role).Has(permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission: " + permission})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,16 +1,22 @@
 package middleware
 
 import (
+	"defdrive/models"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
 )
 
-// AuthRequired is a middleware to authenticate requests
-func AuthRequired() gin.HandlerFunc {
+// AuthRequired is a middleware to authenticate requests with either a JWT
+// access token or a personal access token. Access tokens are bound to a
+// session, which is checked on every request so that logging out or revoking
+// a session invalidates its tokens immediately.
+func AuthRequired(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get authorization header
 		authHeader := c.GetHeader("Authorization")
@@ -31,6 +37,14 @@ func AuthRequired() gin.HandlerFunc {
 		// Extract the token
 		tokenString := headerParts[1]
 
+		// Personal access tokens are looked up in the database instead of parsed
+		if strings.HasPrefix(tokenString, models.TokenPrefix) {
+			if authenticatePersonalToken(c, db, tokenString) {
+				c.Next()
+			}
+			return
+		}
+
 		// Parse and validate the token
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 			// Ensure the token method conforms to "SigningMethodHMAC"
@@ -46,15 +60,75 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 
-		// Extract user ID from token claims
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			c.Set("userID", uint(claims["userID"].(float64)))
-		} else {
+		// Extract user ID and session ID from token claims
+		claims, ok := token.Claims.(jwt.MapClaims)
+		userIDClaim, hasUserID := claims["userID"].(float64)
+		sessionID, hasSession := claims["sid"].(string)
+		if !ok || !hasUserID || !hasSession {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
 			c.Abort()
 			return
 		}
+		userID := uint(userIDClaim)
+
+		var session models.Session
+		if err := db.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil || !session.Active(time.Now()) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+			c.Abort()
+			return
+		}
 
+		c.Set("userID", userID)
+		c.Set("sessionID", sessionID)
+
+		c.Next()
+	}
+}
+
+// authenticatePersonalToken validates a personal access token and stores its
+// scopes in the context for RequireScope. It writes the error response and
+// returns false if the token is unknown, expired or revoked.
+func authenticatePersonalToken(c *gin.Context, db *gorm.DB, tokenString string) bool {
+	var token models.PersonalAccessToken
+	now := time.Now()
+	if err := db.Where("token_hash = ?", models.HashToken(tokenString)).First(&token).Error; err != nil || !token.Active(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid, expired or revoked token"})
+		c.Abort()
+		return false
+	}
+
+	// Record usage at most once a minute to avoid a write on every request
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		db.Model(&token).Update("last_used_at", now)
+	}
+
+	c.Set("userID", token.UserID)
+	c.Set("personalToken", token)
+	return true
+}
+
+// RequireScope rejects requests authenticated with a personal access token
+// that was not granted scope. Session logins may use every route.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token, ok := c.Get("personalToken"); ok && !token.(models.PersonalAccessToken).HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token is missing scope: " + scope})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// SessionRequired rejects requests authenticated with a personal access token,
+// for routes that manage the account itself such as sessions and tokens
+func SessionRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("personalToken"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint requires logging in with a password"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
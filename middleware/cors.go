@@ -15,12 +15,14 @@ func CORSMiddleware() gin.HandlerFunc {
 		} else {
 			c.Writer.Header().Set("Access-Control-Allow-Origin", "*") // Fallback to * if
 		}
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Defer-Length, X-Access-Password")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Upload-Offset, Upload-Length, Upload-Metadata, DefDrive-File-ID")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true") // Allow credentials
 
-		// If it's a preflight request, return immediately
-		if c.Request.Method == "OPTIONS" {
+		// If it's a preflight request, return immediately. Other OPTIONS requests
+		// (such as tus discovery) are passed on to their handlers.
+		if c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != "" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
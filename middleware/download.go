@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"defdrive/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultResumeWindow is how long a granted download can be resumed without counting as another use
+const defaultResumeWindow = 24 * time.Hour
+
+// resumeWindow returns the DOWNLOAD_RESUME_WINDOW duration, falling back to the default
+func resumeWindow() time.Duration {
+	if value := os.Getenv("DOWNLOAD_RESUME_WINDOW"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Warning: invalid DOWNLOAD_RESUME_WINDOW %q, using %s", value, defaultResumeWindow)
+	}
+	return defaultResumeWindow
+}
+
+// resumeOverlap is how many bytes already served a resuming range may read
+// again, covering data that was sent but never reached the client
+const resumeOverlap = 1 << 20
+
+// downloadClaim is the part of the file a response serves within a download session
+type downloadClaim struct {
+	SessionID  uint
+	Start, End int64 // Inclusive byte offsets
+}
+
+// countsAsDownload reports whether the request uses up the link. HEAD requests
+// and conditional requests answered with 304 are served without counting, and
+// so is a range request continuing the pass over the file of a download this
+// client was already granted. Such a request claims its range in the session,
+// which is returned, so that the same bytes cannot be read again for free.
+func countsAsDownload(c *gin.Context, db *gorm.DB, access models.Access, version models.FileVersion) (*downloadClaim, bool) {
+	if c.Request.Method == http.MethodHead {
+		return nil, false
+	}
+
+	etag := version.ETag()
+	if isNotModified(c.Request, etag, version.CreatedAt) {
+		return nil, false
+	}
+
+	// A range starting at byte 0 is a fresh download
+	start, end, ok := requestedRange(c.Request, etag, version.CreatedAt, version.Size)
+	if !ok || start == 0 {
+		return nil, true
+	}
+
+	var session models.DownloadSession
+	if err := db.Where("access_id = ? AND client_ip = ? AND etag = ? AND expires_at > ?", access.ID, c.ClientIP(), etag, time.Now()).
+		Order("id DESC").First(&session).Error; err != nil {
+		return nil, true
+	}
+
+	// The range must pick up where the session stopped and reach bytes not served yet
+	result := db.Model(&models.DownloadSession{}).
+		Where("id = ? AND served <= ? AND served <= ?", session.ID, start+resumeOverlap, end).
+		Update("served", end+1)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, true
+	}
+	return &downloadClaim{SessionID: session.ID, Start: start, End: end}, false
+}
+
+// recordDownloadSession lets the client resume the download it was just granted
+func recordDownloadSession(c *gin.Context, db *gorm.DB, access models.Access, version models.FileVersion) *downloadClaim {
+	now := time.Now()
+
+	// Expired sessions of this link are no longer useful
+	db.Where("access_id = ? AND expires_at <= ?", access.ID, now).Delete(&models.DownloadSession{})
+
+	start, end, ok := requestedRange(c.Request, version.ETag(), version.CreatedAt, version.Size)
+	if !ok {
+		start, end = 0, version.Size-1
+	}
+
+	session := models.DownloadSession{
+		AccessID:  access.ID,
+		ClientIP:  c.ClientIP(),
+		ETag:      version.ETag(),
+		Served:    end + 1,
+		ExpiresAt: now.Add(resumeWindow()),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		log.Printf("Failed to record download session for access %d: %v", access.ID, err)
+		return nil
+	}
+	return &downloadClaim{SessionID: session.ID, Start: start, End: end}
+}
+
+// settle gives back the part of the claim that was not served once the
+// handler is done, so that an interrupted download resumes where it stopped
+func (claim downloadClaim) settle(c *gin.Context, db *gorm.DB) {
+	served := claim.Start
+	if status := c.Writer.Status(); (status == http.StatusOK || status == http.StatusPartialContent) && c.Writer.Size() > 0 {
+		served += int64(c.Writer.Size())
+	}
+	if served > claim.End {
+		return
+	}
+
+	// Leave the session alone if a later request has claimed more since
+	db.Model(&models.DownloadSession{}).
+		Where("id = ? AND served = ?", claim.SessionID, claim.End+1).
+		Update("served", served)
+}
+
+// isNotModified mirrors the If-None-Match / If-Modified-Since evaluation of
+// http.ServeContent, reporting whether the response will be 304 Not Modified
+func isNotModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		return err == nil && !modTime.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// requestedRange returns the first and last byte of a request for a single
+// satisfiable range with an If-Range validator (if any) that still matches
+func requestedRange(r *http.Request, etag string, modTime time.Time, size int64) (int64, int64, bool) {
+	rangeHeader := r.Header.Get("Range")
+	if !strings.HasPrefix(rangeHeader, "bytes=") {
+		return 0, 0, false
+	}
+
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, `W/"`) {
+			// If-Range requires a strong comparison
+			if ifRange != etag || strings.HasPrefix(etag, "W/") {
+				return 0, 0, false
+			}
+		} else if since, err := http.ParseTime(ifRange); err != nil || !modTime.Truncate(time.Second).Equal(since) {
+			return 0, 0, false
+		}
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(rangeHeader, "bytes="))
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+	if first == "" {
+		// A suffix range such as "-500" asks for the last bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+// weakETagMatch compares two entity tags ignoring the weak indicator
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
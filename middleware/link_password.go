@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"defdrive/lockout"
+	"defdrive/models"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AccessPasswordHeader carries the password of a protected access link
+	AccessPasswordHeader = "X-Access-Password"
+
+	unlockTokenType    = "link_unlock"
+	defaultUnlockTTL   = time.Hour
+	unlockCookiePrefix = "defdrive_unlock_"
+)
+
+// unlockTTL returns how long a link stays unlocked after the password was entered (LINK_UNLOCK_TTL)
+func unlockTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LINK_UNLOCK_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultUnlockTTL
+}
+
+// passwordFingerprint identifies the current password of an access, so that
+// unlock cookies stop working when the password is changed
+func passwordFingerprint(access models.Access) string {
+	sum := sha256.Sum256([]byte(access.PasswordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+func unlockCookieName(access models.Access) string {
+	return fmt.Sprintf("%s%d", unlockCookiePrefix, access.ID)
+}
+
+// validUnlockCookie reports whether the request carries an unlock cookie for the access's current password
+func validUnlockCookie(access models.Access, c *gin.Context) bool {
+	cookie, err := c.Cookie(unlockCookieName(access))
+	if err != nil || cookie == "" {
+		return false
+	}
+
+	token, err := jwt.Parse(cookie, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.NewValidationError("unexpected signing method", jwt.ValidationErrorSignatureInvalid)
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	accessID, _ := claims["aid"].(float64)
+	return ok && claims["typ"] == unlockTokenType && uint(accessID) == access.ID && claims["pwd"] == passwordFingerprint(access)
+}
+
+// setUnlockCookie lets the client download the link again (e.g. to resume)
+// without resending the password until the cookie expires
+func setUnlockCookie(access models.Access, c *gin.Context) {
+	ttl := unlockTTL()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aid": access.ID,
+		"typ": unlockTokenType,
+		"pwd": passwordFingerprint(access),
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+	value, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	if err != nil {
+		return
+	}
+
+	secure := c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(unlockCookieName(access), value, int(ttl.Seconds()), "/link/"+access.Link, "", secure, true)
+}
+
+// checkPassword lets requests for a password-protected access through if they
+// carry a valid unlock cookie, or the password in the X-Access-Password header
+// or the "password" field of a POSTed form. Password attempts are throttled
+// per link and client IP like logins.
+func checkPassword(access models.Access, limiter *lockout.Limiter, c *gin.Context) bool {
+	if access.PasswordHash == "" || validUnlockCookie(access, c) {
+		return true
+	}
+
+	password := c.GetHeader(AccessPasswordHeader)
+	if password == "" && c.Request.Method == http.MethodPost {
+		password = c.PostForm("password")
+	}
+
+	if password == "" {
+		denyAccess(c, http.StatusUnauthorized, models.DenyPasswordRequired, gin.H{"error": "This link is password protected", "password_required": true})
+		return false
+	}
+
+	ctx := c.Request.Context()
+	reservation, wait, err := limiter.Reserve(ctx, limiter.LinkAttempts(access.ID, c.ClientIP()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password attempts"})
+		c.Abort()
+		return false
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		denyAccess(c, http.StatusTooManyRequests, models.DenyPasswordAttempts, gin.H{
+			"error":       "Too many wrong passwords, try again later",
+			"retry_after": seconds,
+		})
+		return false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(access.PasswordHash), []byte(password)) != nil {
+		if wait, err := limiter.Fail(ctx, reservation); err != nil {
+			log.Printf("Failed to record wrong password for access %d: %v", access.ID, err)
+		} else if wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+		denyAccess(c, http.StatusUnauthorized, models.DenyInvalidPassword, gin.H{"error": "Invalid password", "password_required": true})
+		return false
+	}
+	if err := limiter.Release(ctx, reservation); err != nil {
+		log.Printf("Failed to release password attempt for access %d: %v", access.ID, err)
+	}
+
+	setUnlockCookie(access, c)
+	return true
+}
@@ -1,22 +1,46 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type Access struct {
 	gorm.Model
-	Name       string
-	Link       string   `gorm:"uniqueIndex"` // Unique index to ensure the link is unique
-	Subnets    []string `gorm:"type:text[]"` // Array of subnets
-	IPs        []string `gorm:"type:text[]"` // Array of IPs
-	Expires    string
-	Public     bool `gorm:"default:false"` // Flag indicating if access is public or restricted
-	OneTimeUse bool `gorm:"default:false"` // Flag indicating if the link is one-time use
-	Used       bool `gorm:"default:false"` // Flag indicating if the link has been used
-	TTL        int  `gorm:"default:0"`     // Time to live (number of hops)
-	EnableTTL  bool `gorm:"default:false"` // Flag to enable or disable TTL
+	Name      string
+	Link      string     `gorm:"uniqueIndex"`     // Unique index to ensure the link is unique
+	Subnets   []string   `gorm:"serializer:json"` // Subnets clients must be in, in CIDR notation
+	IPs       []string   `gorm:"serializer:json"` // Addresses or ranges such as "10.0.0.1-10.0.0.99" clients must match
+	Expires   *time.Time // The link stops working at this time; nil never expires
+	NotBefore *time.Time // The link only works from this time on; nil is active immediately
+	Schedule  *Schedule  `gorm:"serializer:json"` // Recurring time windows the link works in; nil is always
+	Public    bool       `gorm:"default:false"`   // Flag indicating if access is public or restricted
+	Version   int        `gorm:"default:0"`       // Pinned file version; 0 always serves the current version
+
+	MaxDownloads  int `gorm:"default:0"` // Number of downloads the link allows; 0 means unlimited
+	DownloadCount int `gorm:"default:0"` // Downloads redeemed so far
+
+	MaxBytes  int64 `gorm:"default:0"` // Data transfer budget in bytes; 0 means unlimited
+	BytesUsed int64 `gorm:"default:0"` // Bytes streamed through the link so far, including aborted downloads
+
+	DenySubnets []string `gorm:"serializer:json"` // Subnets blocked even if the other restrictions allow them
+	DenyIPs     []string `gorm:"serializer:json"` // Addresses or ranges blocked even if the other restrictions allow them
+
+	AllowCountries []string `gorm:"serializer:json"` // ISO 3166-1 alpha-2 codes of the countries clients must be in; empty allows all
+	DenyCountries  []string `gorm:"serializer:json"` // ISO 3166-1 alpha-2 codes of the countries clients must not be in
+	AllowASNs      []uint   `gorm:"serializer:json"` // Autonomous systems clients must belong to; empty allows all
+	DenyASNs       []uint   `gorm:"serializer:json"` // Autonomous systems clients must not belong to
+
+	PasswordHash      string `json:"-"` // bcrypt hash of the password recipients must enter, empty if none
+	PasswordProtected bool   `gorm:"-"` // Set from PasswordHash when loaded
 
 	FileID uint `gorm:"index"`                           // Foreign key referencing the File model, indexed for query performance
 	File   File `gorm:"foreignKey:FileID;references:ID"` // Relationship to File model
 }
+
+// AfterFind reports whether the access needs a password without exposing the hash
+func (a *Access) AfterFind(tx *gorm.DB) error {
+	a.PasswordProtected = a.PasswordHash != ""
+	return nil
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+// Outcomes of a request for an access link
+const (
+	EventAllowed = "allowed"
+	EventDenied  = "denied"
+	EventError   = "error"
+)
+
+// Reasons a request for an access link was denied
+const (
+	DenyNotPublic        = "not_public"
+	DenyFileNotFound     = "file_not_found"
+	DenyVersionNotFound  = "version_not_found"
+	DenyBlocked          = "blocked"
+	DenySubnet           = "subnet"
+	DenyIP               = "ip"
+	DenyCountry          = "country"
+	DenyASN              = "asn"
+	DenyGeoUnavailable   = "geoip_unavailable"
+	DenyExpired          = "expired"
+	DenyNotYetActive     = "not_yet_active"
+	DenyOutsideSchedule  = "outside_schedule"
+	DenyPasswordRequired = "password_required"
+	DenyInvalidPassword  = "invalid_password"
+	DenyPasswordAttempts = "password_attempts"
+	DenyDataCap          = "data_cap"
+	DenyDownloadLimit    = "download_limit"
+)
+
+// AccessEvent records a single request for an access link, whether it was
+// allowed or denied, so that owners can see who fetched their file
+type AccessEvent struct {
+	ID          uint      `gorm:"primaryKey"`
+	AccessID    uint      `gorm:"index:idx_access_events_access_created"`
+	CreatedAt   time.Time `gorm:"index:idx_access_events_access_created"`
+	ClientIP    string
+	UserAgent   string
+	Referer     string
+	Method      string
+	Status      int
+	Outcome     string // EventAllowed, EventDenied or EventError
+	Reason      string // One of the Deny* reasons for denied requests
+	Download    bool   // Whether the request started a new download, as opposed to resuming or revalidating one
+	BytesServed int64
+	DurationMS  int64
+}
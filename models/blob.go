@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Blob is a stored file content shared by every file with the same SHA-256 hash
+type Blob struct {
+	Hash      string `gorm:"primaryKey;size:64"` // Hex encoded SHA-256 of the content
+	Size      int64
+	Location  string // Key of the object in the storage backend
+	RefCount  int    `gorm:"default:0"` // Number of rows referencing this blob
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// DownloadSession remembers that a client was granted a download through an
+// access link, so that range requests resuming the same content do not count
+// as another use of the link. A session covers a single pass over the file:
+// ranges re-reading bytes before Served count as a new download.
+type DownloadSession struct {
+	ID        uint `gorm:"primaryKey"`
+	AccessID  uint `gorm:"index"`
+	ClientIP  string
+	ETag      string    `gorm:"column:etag"`
+	Served    int64     `gorm:"not null;default:0"` // End of the bytes served or being served so far
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// Purposes of emailed tokens
+const (
+	TokenPurposePasswordReset = "password_reset"
+	TokenPurposeVerifyEmail   = "verify_email"
+)
+
+// EmailToken records a signed token sent by email so that it can be used only
+// once. The token itself is a JWT whose "jti" claim is the ID.
+type EmailToken struct {
+	ID        string `gorm:"primaryKey;size:36"`
+	UserID    uint   `gorm:"index"`
+	Purpose   string
+	Email     string    // Address the token was sent to
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
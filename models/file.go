@@ -9,11 +9,15 @@ type File struct {
 	Name     string
 	Location string
 	Size     int64
-	Hash     string
-	Public   bool `gorm:"default:false"`
-	
-	UserID   uint `gorm:"index"`
-	User     User `gorm:"foreignKey:UserID;references:ID"`
-	
-	Accesses []Access `gorm:"foreignKey:FileID;references:ID"` // One-to-many relationship with Access model
+	Hash     string `gorm:"index"` // SHA-256 of the content, shared with the stored blob
+	Public   bool   `gorm:"default:false"`
+	Version  int    `gorm:"default:1"` // Current version number; Location, Size and Hash describe it
+
+	FolderID *uint `gorm:"index"` // Nil for files at the root of the user's drive
+
+	UserID uint `gorm:"index"`
+	User   User `gorm:"foreignKey:UserID;references:ID"`
+
+	Accesses []Access      `gorm:"foreignKey:FileID;references:ID"` // One-to-many relationship with Access model
+	Versions []FileVersion `gorm:"foreignKey:FileID;references:ID"` // Content history, including the current version
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FileVersion is one revision of a file's content. The file row mirrors its
+// current (highest) version; every version holds a reference to its blob.
+type FileVersion struct {
+	ID        uint `gorm:"primaryKey"`
+	FileID    uint `gorm:"uniqueIndex:idx_file_version"`
+	Version   int  `gorm:"uniqueIndex:idx_file_version"` // Starts at 1 and increases with every upload or restore
+	Size      int64
+	Hash      string `gorm:"index"`
+	Location  string
+	CreatedAt time.Time
+}
+
+// ETag returns the entity tag served for this version's content. Content is
+// addressed by its SHA-256, so the hash is a strong validator.
+func (v FileVersion) ETag() string {
+	if v.Hash != "" {
+		return `"` + v.Hash + `"`
+	}
+	return fmt.Sprintf(`W/"%d-%d-%d"`, v.FileID, v.Version, v.Size)
+}
+
+// ServedVersion loads the version an access link serves: the pinned version, or the file's current one
+func ServedVersion(db *gorm.DB, access Access, file File) (FileVersion, error) {
+	version := file.Version
+	if access.Version > 0 {
+		version = access.Version
+	}
+
+	var fileVersion FileVersion
+	err := db.Where("file_id = ? AND version = ?", file.ID, version).First(&fileVersion).Error
+	return fileVersion, err
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+type Folder struct {
+	gorm.Model
+	Name string
+
+	ParentID *uint   `gorm:"index"` // Nil for folders at the root of the user's drive
+	Parent   *Folder `gorm:"foreignKey:ParentID;references:ID"`
+
+	UserID uint `gorm:"index"`
+	User   User `gorm:"foreignKey:UserID;references:ID"`
+
+	Children []Folder `gorm:"foreignKey:ParentID;references:ID"` // Subfolders
+	Files    []File   `gorm:"foreignKey:FolderID;references:ID"` // Files directly inside this folder
+}
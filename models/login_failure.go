@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// LoginFailure counts failed logins for a username or client IP when the
+// lockout counters are shared between replicas (LOCKOUT_STORE=database)
+type LoginFailure struct {
+	Key         string `gorm:"primaryKey;size:320"` // "user:<username>" or "ip:<address>"
+	Failures    int
+	LastFailure time.Time `gorm:"index"`
+	LockedUntil time.Time
+}
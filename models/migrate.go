@@ -0,0 +1,221 @@
+package models
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migrate creates or updates all tables and backfills data for new columns
+func Migrate(db *gorm.DB) error {
+	// Access.Expires used to be a string; keep the old values aside so the column can be recreated as a timestamp
+	if err := renameLegacyExpires(db); err != nil {
+		return err
+	}
+
+	// The address lists of accesses used to be Postgres arrays, which cannot be read into []string
+	if err := convertAddressArrays(db); err != nil {
+		return err
+	}
+
+	// Ensure the tables are created in the correct order
+	if err := db.AutoMigrate(
+		&Role{}, &User{}, &Folder{}, &File{}, &FileVersion{}, &Access{},
+		&Blob{}, &Upload{}, &DownloadSession{}, &Session{},
+		&PersonalAccessToken{}, &RecoveryCode{}, &EmailToken{}, &LoginFailure{}, &AccessEvent{},
+		&Webhook{}, &WebhookDelivery{},
+	); err != nil {
+		return err
+	}
+
+	// Parse the expiry times that were stored as strings
+	if err := migrateLegacyExpires(db); err != nil {
+		return err
+	}
+
+	// Links created with the old one-time use and TTL flags get an equivalent download limit
+	if err := migrateDownloadLimits(db); err != nil {
+		return err
+	}
+
+	// Make sure the built-in roles exist
+	if err := seedRoles(db); err != nil {
+		return err
+	}
+
+	// Files uploaded before versioning get their content recorded as version 1
+	if err := db.Exec(`
+		INSERT INTO file_versions (file_id, version, size, hash, location, created_at)
+		SELECT f.id, 1, f.size, f.hash, f.location, f.created_at
+		FROM files f
+		WHERE f.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id = f.id)
+	`).Error; err != nil {
+		return err
+	}
+
+	// Files deleted before the trash existed had their content removed, so they cannot be restored
+	return purgeLegacyTrash(db)
+}
+
+// purgeLegacyTrash permanently deletes soft-deleted files without any version,
+// together with their accesses. Their stored content was already removed when
+// they were deleted.
+func purgeLegacyTrash(db *gorm.DB) error {
+	orphans := db.Unscoped().Model(&File{}).Select("id").
+		Where("deleted_at IS NOT NULL AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id = files.id)")
+
+	var count int64
+	if err := orphans.Session(&gorm.Session{}).Count(&count).Error; err != nil || count == 0 {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		accesses := tx.Unscoped().Model(&Access{}).Select("id").Where("file_id IN (?)", orphans)
+		if err := tx.Where("access_id IN (?)", accesses).Delete(&DownloadSession{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("access_id IN (?)", accesses).Delete(&AccessEvent{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("file_id IN (?)", orphans).Delete(&Access{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id IN (?)", orphans).Delete(&File{}).Error; err != nil {
+			return err
+		}
+		log.Printf("Removed %d files deleted before the trash existed", count)
+		return nil
+	})
+}
+
+// migrateDownloadLimits converts the legacy OneTimeUse/Used and EnableTTL/TTL columns
+// into MaxDownloads/DownloadCount and drops them
+func migrateDownloadLimits(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Access{}, "one_time_use") {
+		return nil
+	}
+
+	var legacy []struct {
+		ID         uint
+		OneTimeUse bool
+		Used       bool
+		TTL        int
+		EnableTTL  bool
+	}
+	if err := db.Raw(`SELECT id, one_time_use, used, ttl, enable_ttl FROM accesses
+		WHERE one_time_use OR (enable_ttl AND ttl > 0)`).Scan(&legacy).Error; err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, a := range legacy {
+			// A TTL of n allowed n-1 more downloads; a one-time link allowed one unless used
+			remaining := -1
+			if a.OneTimeUse {
+				remaining = 1
+				if a.Used {
+					remaining = 0
+				}
+			}
+			if a.EnableTTL && a.TTL > 0 && (remaining < 0 || a.TTL-1 < remaining) {
+				remaining = a.TTL - 1
+			}
+
+			limits := map[string]interface{}{"max_downloads": remaining, "download_count": 0}
+			if remaining == 0 {
+				limits = map[string]interface{}{"max_downloads": 1, "download_count": 1}
+			}
+			if err := tx.Model(&Access{}).Unscoped().Where("id = ?", a.ID).UpdateColumns(limits).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, column := range []string{"one_time_use", "used", "ttl", "enable_ttl"} {
+			if err := tx.Migrator().DropColumn(&Access{}, column); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// convertAddressArrays converts the accesses.subnets and ips columns from
+// text[] to the JSON text the lists are now stored as
+func convertAddressArrays(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" || !db.Migrator().HasTable(&Access{}) {
+		return nil
+	}
+
+	columns, err := db.Migrator().ColumnTypes(&Access{})
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		name := column.Name()
+		if (name != "subnets" && name != "ips") || !strings.HasSuffix(column.DatabaseTypeName(), "[]") {
+			continue
+		}
+		if err := db.Exec("ALTER TABLE accesses ALTER COLUMN " + name + " TYPE text USING array_to_json(" + name + ")::text").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameLegacyExpires renames the accesses.expires column to expires_legacy if it still holds strings
+func renameLegacyExpires(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Access{}, "expires") {
+		return nil
+	}
+
+	columns, err := db.Migrator().ColumnTypes(&Access{})
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if column.Name() != "expires" {
+			continue
+		}
+		switch strings.ToLower(column.DatabaseTypeName()) {
+		case "text", "varchar", "character varying":
+			return db.Migrator().RenameColumn(&Access{}, "expires", "expires_legacy")
+		}
+	}
+	return nil
+}
+
+// migrateLegacyExpires converts the RFC 3339 strings in expires_legacy into
+// the expires column and drops it. Values that cannot be parsed made the link
+// expired, so they are migrated as already expired.
+func migrateLegacyExpires(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&Access{}, "expires_legacy") {
+		return nil
+	}
+
+	var legacy []struct {
+		ID            uint
+		ExpiresLegacy string
+	}
+	if err := db.Raw("SELECT id, expires_legacy FROM accesses WHERE expires_legacy IS NOT NULL AND expires_legacy <> ''").
+		Scan(&legacy).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, a := range legacy {
+			expires, err := time.Parse(time.RFC3339, a.ExpiresLegacy)
+			if err != nil {
+				log.Printf("Warning: access %d has an invalid expiry %q, migrating it as expired", a.ID, a.ExpiresLegacy)
+				expires = now
+			}
+			if err := tx.Model(&Access{}).Unscoped().Where("id = ?", a.ID).UpdateColumn("expires", expires).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn(&Access{}, "expires_legacy")
+	})
+}
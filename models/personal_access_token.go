@@ -0,0 +1,69 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// TokenPrefix starts every personal access token, so that AuthRequired can
+// tell them apart from JWTs and secret scanners can recognize leaked ones
+const TokenPrefix = "ddp_"
+
+// Scopes that can be granted to a personal access token
+const (
+	ScopeFilesRead      = "files:read"      // List and download files, versions, folders and trash
+	ScopeFilesWrite     = "files:write"     // Upload, change and delete files and folders
+	ScopeAccessesManage = "accesses:manage" // Create, change and delete access links
+)
+
+// Scopes lists every scope a personal access token can be granted
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeAccessesManage}
+
+// ValidScope reports whether scope can be granted to a token
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PersonalAccessToken lets scripts authenticate as a user without a password.
+// Only a SHA-256 hash of the token is stored.
+type PersonalAccessToken struct {
+	ID         uint `gorm:"primaryKey"`
+	Name       string
+	Prefix     string     // First characters of the token, to tell tokens apart
+	TokenHash  string     `gorm:"uniqueIndex" json:"-"`
+	Scopes     []string   `gorm:"serializer:json"`
+	ExpiresAt  *time.Time // Never expires if nil
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+
+	UserID uint `gorm:"index"`
+	User   User `gorm:"foreignKey:UserID;references:ID" json:"-"`
+}
+
+// Active reports whether the token can be used at time now
+func (t PersonalAccessToken) Active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || now.Before(*t.ExpiresAt))
+}
+
+// HasScope reports whether the token was granted scope
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HashToken returns the hex SHA-256 of a secret token, which is what gets stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Names of the built-in roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Permissions that can be granted to a role
+const (
+	PermissionUsersRead   = "users:read"   // List users and their limits
+	PermissionUsersLimits = "users:limits" // Change user limits
+	PermissionUsersRoles  = "users:roles"  // Assign roles to users
+	PermissionUsers2FA    = "users:2fa"    // Reset two-factor authentication of users
+	PermissionLockouts    = "lockouts"     // View and clear login lockouts
+	PermissionRolesManage = "roles:manage" // Create, update and delete custom roles
+	PermissionAll         = "*"            // Every permission
+)
+
+// Permissions lists every permission a custom role can be granted
+var Permissions = []string{
+	PermissionUsersRead,
+	PermissionUsersLimits,
+	PermissionUsersRoles,
+	PermissionUsers2FA,
+	PermissionLockouts,
+	PermissionRolesManage,
+}
+
+// Role is a named set of permissions assigned to users
+type Role struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	Permissions []string `gorm:"serializer:json"`
+	BuiltIn     bool     `gorm:"default:false"` // Built-in roles cannot be changed or deleted
+}
+
+// Has reports whether the role grants permission
+func (r Role) Has(permission string) bool {
+	for _, p := range r.Permissions {
+		if p == permission || p == PermissionAll {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPermission reports whether permission can be granted to a role
+func ValidPermission(permission string) bool {
+	for _, p := range Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// seedRoles creates the built-in roles if they do not exist yet
+func seedRoles(db *gorm.DB) error {
+	builtIn := []Role{
+		{Name: RoleUser, Description: "Regular user", Permissions: []string{}, BuiltIn: true},
+		{Name: RoleAdmin, Description: "Administrator with every permission", Permissions: []string{PermissionAll}, BuiltIn: true},
+	}
+	for _, role := range builtIn {
+		if err := db.Where(Role{Name: role.Name}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PromoteAdmins gives the admin role to the users with the given usernames,
+// as long as no user holds it yet. It bootstraps the first administrators from
+// ADMIN_USERNAMES; afterwards roles are only changed through the API, so a
+// demoted administrator does not get the role back on the next start.
+func PromoteAdmins(db *gorm.DB, usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	var admins int64
+	if err := db.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	return db.Model(&User{}).Where("username IN ?", usernames).Update("role", RoleAdmin).Error
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps the day names accepted in schedules to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Schedule restricts an access link to recurring time windows, such as
+// business hours on weekdays in a given time zone
+type Schedule struct {
+	Timezone string       `json:"timezone"` // IANA time zone such as "Europe/Berlin"; empty uses the server's (TZ)
+	Days     []string     `json:"days"`     // "mon" to "sun"; empty means every day
+	Windows  []TimeWindow `json:"windows"`  // Empty means the whole day
+}
+
+// TimeWindow is a daily opening window. A window ending before it starts runs
+// past midnight and belongs to the day it starts on.
+type TimeWindow struct {
+	Start string `json:"start"` // "HH:MM"
+	End   string `json:"end"`   // "HH:MM", exclusive; "24:00" is the end of the day
+}
+
+// Validate checks and normalizes the schedule
+func (s *Schedule) Validate() error {
+	if _, err := s.location(); err != nil {
+		return fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+
+	seen := map[string]bool{}
+	days := make([]string, 0, len(s.Days))
+	for _, day := range s.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		if _, ok := weekdays[day]; !ok {
+			return fmt.Errorf("unknown day %q, expected mon to sun", day)
+		}
+		if !seen[day] {
+			seen[day] = true
+			days = append(days, day)
+		}
+	}
+	s.Days = days
+
+	for _, w := range s.Windows {
+		start, err := parseClock(w.Start)
+		if err != nil || start == 24*60 {
+			return fmt.Errorf("invalid window start %q, expected HH:MM", w.Start)
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return fmt.Errorf("invalid window end %q, expected HH:MM", w.End)
+		}
+		if start == end {
+			return fmt.Errorf("window %s-%s is empty", w.Start, w.End)
+		}
+	}
+	return nil
+}
+
+// Open reports whether the schedule allows access at t
+func (s *Schedule) Open(t time.Time) bool {
+	for _, interval := range s.intervals(t) {
+		if !t.Before(interval[0]) && t.Before(interval[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when the schedule next allows access after t, in the
+// schedule's time zone, or false if it never does
+func (s *Schedule) NextOpen(t time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, interval := range s.intervals(t) {
+		if interval[0].After(t) && (next.IsZero() || interval[0].Before(next)) {
+			next = interval[0]
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// intervals returns the opening intervals from the day before t to a week after it
+func (s *Schedule) intervals(t time.Time) [][2]time.Time {
+	loc, err := s.location()
+	if err != nil {
+		return nil
+	}
+
+	windows := s.Windows
+	if len(windows) == 0 {
+		windows = []TimeWindow{{Start: "00:00", End: "24:00"}}
+	}
+
+	local := t.In(loc)
+	var intervals [][2]time.Time
+	for offset := -1; offset <= 8; offset++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		if !s.onDay(day.Weekday()) {
+			continue
+		}
+		for _, w := range windows {
+			start, err1 := parseClock(w.Start)
+			end, err2 := parseClock(w.End)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			if end <= start {
+				end += 24 * 60
+			}
+			intervals = append(intervals, [2]time.Time{
+				time.Date(day.Year(), day.Month(), day.Day(), 0, start, 0, 0, loc),
+				time.Date(day.Year(), day.Month(), day.Day(), 0, end, 0, 0, loc),
+			})
+		}
+	}
+	return intervals
+}
+
+func (s *Schedule) onDay(weekday time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, day := range s.Days {
+		if weekdays[day] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, allowing "24:00"
+func parseClock(value string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(value, "%d:%d", &h, &m); err != nil || len(value) != 5 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return h*60 + m, nil
+}
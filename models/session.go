@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is a login of a user. Access tokens carry the session ID and are
+// rejected once the session is revoked. The refresh token is stored as a
+// SHA-256 hash and replaced every time it is used.
+type Session struct {
+	ID          string `gorm:"primaryKey;size:36"` // UUID, the "sid" claim of access tokens
+	RefreshHash string `json:"-"`                  // Hash of the current refresh token
+	UserAgent   string
+	ClientIP    string
+	ExpiresAt   time.Time  `gorm:"index"` // Refresh tokens cannot be used after this time
+	LastUsedAt  time.Time  // Last time the session was refreshed
+	RevokedAt   *time.Time `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+
+	UserID uint `gorm:"index"`
+	User   User `gorm:"foreignKey:UserID;references:ID" json:"-"`
+}
+
+// Active reports whether the session can still be used at time now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// Upload is an unfinished resumable (tus) upload. Received data is stored as
+// chunks in the storage backend until Offset reaches Length. Uploads that see
+// no data until ExpiresAt are discarded.
+type Upload struct {
+	ID        string `gorm:"primaryKey;size:36"` // UUID used in the upload URL
+	Name      string
+	Length    int64     // Total size announced by the client
+	Offset    int64     `gorm:"column:upload_offset;default:0"` // Number of bytes received so far
+	Metadata  string    // Raw Upload-Metadata header
+	FolderID  *uint     // Folder the file is created in
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID uint `gorm:"index"`
+	User   User `gorm:"foreignKey:UserID;references:ID"`
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -10,6 +12,13 @@ type User struct {
 	Email    string
 	Username string `gorm:"unique"`
 	Password string
+	Role     string `gorm:"default:user;index"` // Name of the user's Role, checked on every admin request
+
+	EmailVerifiedAt *time.Time // Set once the user confirmed the address through an emailed link
+
+	TOTPSecret      string `json:"-"`                      // Base32 TOTP secret, set during enrollment
+	TOTPEnabled     bool   `gorm:"default:false" json:"-"` // Login requires a TOTP or recovery code
+	TOTPLastCounter int64  `json:"-"`                      // Time step of the last accepted code, to prevent replays
 	
 	MaxFiles   int   `gorm:"default:100"`        // default 100 files
 	MaxStorage int64 `gorm:"default:1073741824"` // default 1GB
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+)
+
+// Events webhooks can subscribe to
+const (
+	EventFileUploaded = "file.uploaded"
+	EventFileDeleted  = "file.deleted"
+	EventLinkAccessed = "link.accessed"
+	EventLinkDenied   = "link.denied"
+	EventPing         = "ping" // Sent on request to test an endpoint, regardless of subscriptions
+)
+
+// WebhookEvents lists the events webhooks can subscribe to
+var WebhookEvents = []string{EventFileUploaded, EventFileDeleted, EventLinkAccessed, EventLinkDenied}
+
+// ValidWebhookEvent reports whether event can be subscribed to
+func ValidWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is an HTTP endpoint registered by a user to be notified of events
+type Webhook struct {
+	ID          uint `gorm:"primaryKey"`
+	URL         string
+	Description string
+	Secret      string   `json:"-"`               // Key of the HMAC-SHA256 payload signature
+	Events      []string `gorm:"serializer:json"` // Subscribed events
+	Active      bool     `gorm:"default:true"`    // Inactive webhooks receive no new deliveries
+	UserID      uint     `gorm:"index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Subscribed reports whether the webhook wants to receive event
+func (w Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // Gave up after the maximum number of attempts
+)
+
+// WebhookDelivery is a queued event for a webhook together with the outcome
+// of its latest delivery attempt
+type WebhookDelivery struct {
+	ID             uint `gorm:"primaryKey"`
+	WebhookID      uint `gorm:"index"`
+	Event          string
+	Payload        string // JSON body sent to the endpoint
+	Status         string `gorm:"default:pending;index:idx_webhook_deliveries_due"`
+	Attempts       int
+	NextAttemptAt  time.Time `gorm:"index:idx_webhook_deliveries_due"`
+	LastAttemptAt  *time.Time
+	ResponseStatus int
+	ResponseBody   string // Start of the endpoint's response body
+	Error          string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
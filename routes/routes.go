@@ -1,8 +1,15 @@
 package routes
 
 import (
+	"defdrive/clientip"
 	"defdrive/controllers"
+	"defdrive/geoip"
+	"defdrive/lockout"
+	"defdrive/mailer"
 	"defdrive/middleware"
+	"defdrive/models"
+	"defdrive/storage"
+	"defdrive/webhook"
 	"net/http"
 
 	// "github.com/gin-contrib/cors"
@@ -11,18 +18,33 @@ import (
 )
 
 // SetupRouter configures all application routes
-func SetupRouter(db *gorm.DB) *gin.Engine {
+func SetupRouter(db *gorm.DB, blobs *storage.Blobs, mail mailer.Mailer, limiter *lockout.Limiter, hooks *webhook.Dispatcher, geo *geoip.Resolver, proxies *clientip.Resolver) *gin.Engine {
 	router := gin.Default()
 
+	// Client addresses are resolved from trusted proxies only, by the middleware below
+	router.SetTrustedProxies(nil)
+	router.Use(proxies.Middleware())
+
 	// Add CORS middleware
 	// router.Use(cors.Default())
 	router.Use(middleware.CORSMiddleware())
 
 	// Create controllers
-	userController := controllers.NewUserController(db)
-	fileController := controllers.NewFileController(db)
-	accessController := controllers.NewAccessController(db)
-	linkController := controllers.NewLinkController(db)
+	userController := controllers.NewUserController(db, mail, limiter)
+	fileController := controllers.NewFileController(db, blobs, hooks)
+	accessController := controllers.NewAccessController(db, geo)
+	linkController := controllers.NewLinkController(db, blobs.Backend)
+	uploadController := controllers.NewUploadController(db, blobs, hooks)
+	folderController := controllers.NewFolderController(db)
+	trashController := controllers.NewTrashController(db, blobs)
+	roleController := controllers.NewRoleController(db)
+	sessionController := controllers.NewSessionController(db)
+	tokenController := controllers.NewTokenController(db)
+	twoFactorController := controllers.NewTwoFactorController(db, limiter)
+	accountController := controllers.NewAccountController(db, mail)
+	lockoutController := controllers.NewLockoutController(limiter)
+	webhookController := controllers.NewWebhookController(db, hooks)
+	analyticsController := controllers.NewAnalyticsController(db)
 
 	// Group API routes
 	api := router.Group("/api")
@@ -30,40 +52,114 @@ func SetupRouter(db *gorm.DB) *gin.Engine {
 		// User routes (public)
 		api.POST("/signup", userController.SignUp)
 		api.POST("/login", userController.Login)
+		api.POST("/login/2fa", twoFactorController.LoginSecondFactor)
+		api.POST("/token/refresh", sessionController.RefreshToken)
+
+		// Account recovery and email verification (public)
+		api.POST("/password/forgot", accountController.ForgotPassword)
+		api.POST("/password/reset", accountController.ResetPassword)
+		api.GET("/email/verify", accountController.VerifyEmail)
+		api.POST("/email/verify", accountController.VerifyEmail)
+		api.POST("/email/verify/resend", accountController.ResendVerification)
+
+		// Resumable upload discovery (public, tus protocol)
+		api.OPTIONS("/uploads", uploadController.TusOptions)
 
-		// Protected routes
+		// Protected routes, available to session logins and personal access tokens
 		protected := api.Group("")
-		protected.Use(middleware.AuthRequired())
+		protected.Use(middleware.AuthRequired(db))
 		{
-			// User limit routes
-			protected.GET("/user/limits", userController.GetUserLimits)
-
-			// File routes
-			protected.POST("/upload", fileController.Upload)
-			protected.GET("/files", fileController.ListFiles)
-			protected.GET("/files/stats", fileController.GetUserStats)
-			protected.PUT("/files/:fileID/access", fileController.TogglePublicAccess)
-			protected.DELETE("/files/:fileID", fileController.DeleteFile)
-
-			// Access routes
-			protected.POST("/files/:fileID/accesses", accessController.CreateAccess)
-			protected.GET("/files/:fileID/accesses", accessController.ListAccesses)
-			protected.PUT("/accesses/:accessID/access", accessController.UpdateAccess)
-			protected.DELETE("/accesses/:accessID", accessController.DeleteAccess)
-			protected.GET("/accesses/:accessID", accessController.GetAccess)
+			// Account routes (session logins only)
+			account := protected.Group("", middleware.SessionRequired())
+			account.POST("/logout", sessionController.Logout)
+			account.GET("/sessions", sessionController.ListSessions)
+			account.DELETE("/sessions/:sessionID", sessionController.RevokeSession)
+			account.POST("/tokens", tokenController.CreateToken)
+			account.GET("/tokens", tokenController.ListTokens)
+			account.DELETE("/tokens/:tokenID", tokenController.RevokeToken)
+			account.GET("/2fa", twoFactorController.Status)
+			account.POST("/2fa/setup", twoFactorController.Setup)
+			account.POST("/2fa/enable", twoFactorController.Enable)
+			account.POST("/2fa/disable", twoFactorController.Disable)
+			account.POST("/2fa/recovery-codes", twoFactorController.RegenerateRecoveryCodes)
+			account.POST("/webhooks", webhookController.CreateWebhook)
+			account.GET("/webhooks", webhookController.ListWebhooks)
+			account.PUT("/webhooks/:webhookID", webhookController.UpdateWebhook)
+			account.DELETE("/webhooks/:webhookID", webhookController.DeleteWebhook)
+			account.POST("/webhooks/:webhookID/ping", webhookController.PingWebhook)
+			account.GET("/webhooks/:webhookID/deliveries", webhookController.ListDeliveries)
+			account.POST("/webhooks/:webhookID/deliveries/:deliveryID/redeliver", webhookController.Redeliver)
+
+			// Read-only routes (files:read)
+			read := protected.Group("", middleware.RequireScope(models.ScopeFilesRead))
+			read.GET("/user/limits", userController.GetUserLimits)
+			read.GET("/files", fileController.ListFiles)
+			read.GET("/files/stats", fileController.GetUserStats)
+			read.GET("/files/:fileID/versions", fileController.ListVersions)
+			read.GET("/files/:fileID/versions/:version/download", fileController.DownloadVersion)
+			read.GET("/folders", folderController.ListRoot)
+			read.GET("/folders/:folderID", folderController.GetFolder)
+			read.GET("/trash", trashController.ListTrash)
+
+			// File and folder changes (files:write)
+			write := protected.Group("", middleware.RequireScope(models.ScopeFilesWrite))
+			write.POST("/upload", fileController.Upload)
+			write.PATCH("/files/:fileID", fileController.UpdateFile)
+			write.DELETE("/files/:fileID", fileController.DeleteFile)
+			write.POST("/files/:fileID/versions/:version/restore", fileController.RestoreVersion)
+			write.DELETE("/files/:fileID/versions/:version", fileController.DeleteVersion)
+			write.POST("/files/:fileID/versions/prune", fileController.PruneVersions)
+			write.POST("/folders", folderController.CreateFolder)
+			write.PATCH("/folders/:folderID", folderController.UpdateFolder)
+			write.DELETE("/folders/:folderID", folderController.DeleteFolder)
+			write.POST("/trash/:fileID/restore", trashController.RestoreFile)
+			write.DELETE("/trash/:fileID", trashController.DeleteFile)
+			write.DELETE("/trash", trashController.EmptyTrash)
+
+			// Resumable upload routes (tus 1.0: creation, offset, termination)
+			write.POST("/uploads", uploadController.CreateUpload)
+			write.HEAD("/uploads/:uploadID", uploadController.GetUploadOffset)
+			write.PATCH("/uploads/:uploadID", uploadController.PatchUpload)
+			write.DELETE("/uploads/:uploadID", uploadController.DeleteUpload)
+
+			// Access routes (accesses:manage)
+			accesses := protected.Group("", middleware.RequireScope(models.ScopeAccessesManage))
+			accesses.PUT("/files/:fileID/access", fileController.TogglePublicAccess)
+			accesses.POST("/files/:fileID/accesses", accessController.CreateAccess)
+			accesses.GET("/files/:fileID/accesses", accessController.ListAccesses)
+			accesses.PUT("/accesses/:accessID/access", accessController.UpdateAccess)
+			accesses.DELETE("/accesses/:accessID", accessController.DeleteAccess)
+			accesses.GET("/accesses/:accessID", accessController.GetAccess)
+			accesses.GET("/accesses/:accessID/events", accessController.ListAccessEvents)
+			accesses.GET("/accesses/:accessID/analytics", analyticsController.AccessAnalytics)
+			accesses.GET("/files/:fileID/analytics", analyticsController.FileAnalytics)
 		}
 
 		// Admin routes (for managing user limits)
 		admin := api.Group("/admin")
-		admin.Use(middleware.AuthRequired()) // TODO: Make seperate auth for admin
+		admin.Use(middleware.AuthRequired(db), middleware.SessionRequired(), middleware.AdminRequired(db))
 		{
-			admin.GET("/users/limits", userController.GetAllUsersLimits)
-			admin.PUT("/users/:userID/limits", userController.UpdateUserLimits)
+			admin.GET("/users/limits", middleware.RequirePermission(models.PermissionUsersRead), userController.GetAllUsersLimits)
+			admin.PUT("/users/:userID/limits", middleware.RequirePermission(models.PermissionUsersLimits), userController.UpdateUserLimits)
+			admin.PUT("/users/:userID/role", middleware.RequirePermission(models.PermissionUsersRoles), roleController.SetUserRole)
+			admin.DELETE("/users/:userID/2fa", middleware.RequirePermission(models.PermissionUsers2FA), twoFactorController.ResetUser)
+
+			// Lockout routes
+			admin.GET("/lockouts", middleware.RequirePermission(models.PermissionLockouts), lockoutController.ListLockouts)
+			admin.DELETE("/lockouts/:key", middleware.RequirePermission(models.PermissionLockouts), lockoutController.ClearLockout)
+
+			// Role routes
+			admin.GET("/roles", middleware.RequirePermission(models.PermissionRolesManage), roleController.ListRoles)
+			admin.POST("/roles", middleware.RequirePermission(models.PermissionRolesManage), roleController.CreateRole)
+			admin.PUT("/roles/:role", middleware.RequirePermission(models.PermissionRolesManage), roleController.UpdateRole)
+			admin.DELETE("/roles/:role", middleware.RequirePermission(models.PermissionRolesManage), roleController.DeleteRole)
 		}
 	}
 
 	// Public access link route with access restrictions middleware
-	router.GET("/link/:hash", middleware.AccessRestrictions(db), linkController.HandleAccessLink)
+	router.GET("/link/:hash", middleware.AccessRestrictions(db, hooks, geo, limiter), linkController.HandleAccessLink)
+	router.HEAD("/link/:hash", middleware.AccessRestrictions(db, hooks, geo, limiter), linkController.HandleAccessLink)
+	router.POST("/link/:hash", middleware.AccessRestrictions(db, hooks, geo, limiter), linkController.HandleAccessLink) // Password form
 	// router.GET("/link/:hash", linkController.HandleAccessLink)
 
 	// Health check route
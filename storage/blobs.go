@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+
+	"defdrive/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Blobs stores file contents once per SHA-256 hash on a Backend and keeps
+// a reference count for every hash in the database. The physical object is
+// only removed when the last reference is released.
+type Blobs struct {
+	Backend Backend
+	DB      *gorm.DB
+}
+
+// NewBlobs creates a content-addressed store on top of backend
+func NewBlobs(backend Backend, db *gorm.DB) *Blobs {
+	return &Blobs{Backend: backend, DB: db}
+}
+
+// BlobKey returns the storage key for content with the given hash
+func BlobKey(hash string) string {
+	return path.Join("blobs", hash[:2], hash)
+}
+
+// Put streams r to a temporary object while hashing it, then moves it to its
+// content address unless an identical blob is already stored. The returned
+// blob carries one new reference that the caller must Release if it does not
+// end up using it.
+func (b *Blobs) Put(ctx context.Context, r io.Reader, size int64) (models.Blob, error) {
+	tmpKey := path.Join("tmp", uuid.New().String())
+	hasher := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, hasher)}
+
+	if err := b.Backend.Put(ctx, tmpKey, counter, size); err != nil {
+		b.Backend.Delete(context.Background(), tmpKey)
+		return models.Blob{}, err
+	}
+	defer b.Backend.Delete(context.Background(), tmpKey) // No-op once moved into place
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	blob := models.Blob{Hash: hash, Size: counter.n, Location: BlobKey(hash), RefCount: 1}
+
+	// The upsert locks the blob row until commit, serializing concurrent Put and Release calls
+	err := b.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "hash"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"ref_count": gorm.Expr("blobs.ref_count + 1")}),
+		}).Create(&blob).Error; err != nil {
+			return err
+		}
+
+		if _, err := b.Backend.Stat(ctx, blob.Location); errors.Is(err, ErrNotFound) {
+			return b.Backend.Move(ctx, tmpKey, blob.Location)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return models.Blob{}, err
+	}
+	return blob, nil
+}
+
+// Retain adds a reference to an already stored blob, e.g. when a file version
+// is restored and shares the content of an older one
+func (b *Blobs) Retain(ctx context.Context, hash string) error {
+	result := b.DB.Model(&models.Blob{}).Where("hash = ? AND ref_count > 0", hash).Update("ref_count", gorm.Expr("ref_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Release drops one reference to the blob with the given hash. Once nothing
+// references it anymore, the stored object is deleted after the reference
+// count has been committed; if that fails, DeleteReleased retries it later.
+func (b *Blobs) Release(ctx context.Context, hash string) error {
+	var released bool
+	err := b.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		released, err = b.ReleaseTx(tx, hash)
+		return err
+	})
+	if err != nil || !released {
+		return err
+	}
+
+	b.Collect(ctx, hash)
+	return nil
+}
+
+// ReleaseTx drops one reference to the blob with the given hash within tx and
+// reports whether nothing references it anymore. The caller deletes such
+// blobs with Collect once tx is committed.
+func (b *Blobs) ReleaseTx(tx *gorm.DB, hash string) (bool, error) {
+	var blob models.Blob
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, "hash = ? AND ref_count > 0", hash).Error; err != nil {
+		return false, err
+	}
+	if err := tx.Model(&blob).Update("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		return false, err
+	}
+	return blob.RefCount == 1, nil
+}
+
+// Collect deletes the stored objects of the given blobs if nothing references
+// them anymore. Failures are logged and retried by DeleteReleased.
+func (b *Blobs) Collect(ctx context.Context, hashes ...string) {
+	for _, hash := range hashes {
+		if err := b.deleteReleased(ctx, hash); err != nil {
+			log.Printf("Failed to delete released blob %s, will retry: %v", hash, err)
+		}
+	}
+}
+
+// DeleteReleased deletes the objects of blobs that are no longer referenced
+// but could not be deleted when they were released
+func (b *Blobs) DeleteReleased(ctx context.Context) (int, error) {
+	var hashes []string
+	if err := b.DB.Model(&models.Blob{}).Where("ref_count = 0").Pluck("hash", &hashes).Error; err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, hash := range hashes {
+		if err := b.deleteReleased(ctx, hash); err != nil {
+			log.Printf("Failed to delete released blob %s: %v", hash, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteReleased deletes the object and row of a blob without references.
+// The row stays locked meanwhile, so a concurrent Put of the same content
+// waits and then stores the object again.
+func (b *Blobs) deleteReleased(ctx context.Context, hash string) error {
+	return b.DB.Transaction(func(tx *gorm.DB) error {
+		var blob models.Blob
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, "hash = ? AND ref_count = 0", hash).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil // Referenced again or already deleted
+		} else if err != nil {
+			return err
+		}
+
+		if err := b.Backend.Delete(ctx, blob.Location); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		return tx.Delete(&blob).Error
+	})
+}
+
+// MigrateLegacyFiles moves files uploaded before deduplication (stored at
+// username/filename without a hash) into the content-addressed store
+func (b *Blobs) MigrateLegacyFiles(ctx context.Context) error {
+	var files []models.File
+	if err := b.DB.Where("hash = '' OR hash IS NULL").Find(&files).Error; err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := b.migrateLegacyFile(ctx, file); err != nil {
+			// Leave the file in place; it keeps working from its old location
+			log.Printf("Failed to migrate file %d (%s) to deduplicated storage: %v", file.ID, file.Location, err)
+		}
+	}
+	return nil
+}
+
+func (b *Blobs) migrateLegacyFile(ctx context.Context, file models.File) error {
+	src, err := b.Backend.Get(ctx, file.Location)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	blob, err := b.Put(ctx, src, file.Size)
+	if err != nil {
+		return err
+	}
+
+	content := map[string]interface{}{
+		"hash":     blob.Hash,
+		"location": blob.Location,
+		"size":     blob.Size,
+	}
+	err = b.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&file).Updates(content).Error; err != nil {
+			return err
+		}
+		// The version row created for the file points at the same legacy object
+		return tx.Model(&models.FileVersion{}).
+			Where("file_id = ? AND location = ?", file.ID, file.Location).
+			Updates(content).Error
+	})
+	if err != nil {
+		b.Release(ctx, blob.Hash)
+		return err
+	}
+
+	if err := b.Backend.Delete(ctx, file.Location); err != nil {
+		return fmt.Errorf("migrated but failed to remove old object: %w", err)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection settings for an S3-compatible service such as MinIO
+type S3Config struct {
+	Endpoint  string // host:port without scheme
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
+}
+
+// S3 stores objects in a bucket of an S3-compatible service
+type S3 struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// NewS3 connects to the service described by cfg and creates the bucket if it does not exist
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("MINIO_ENDPOINT environment variable not set")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("MINIO_BUCKET_NAME environment variable not set")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %q: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %q: %w", cfg.Bucket, err)
+		}
+	}
+
+	return &S3{Client: client, Bucket: cfg.Bucket}, nil
+}
+
+// Put uploads r, using a multipart upload when the size is unknown or large
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.Client.PutObject(ctx, s.Bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+// Get opens the object for reading. Seeking issues ranged GET requests.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	obj, err := s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, convertS3Error(err)
+	}
+	// GetObject is lazy, so stat the object to surface a missing key now
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, convertS3Error(err)
+	}
+	return obj, nil
+}
+
+// Stat returns the object's size and last modification time
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, convertS3Error(err)
+	}
+	return ObjectInfo{Key: info.Key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// Move copies the object server-side and removes the source. S3 has no rename operation.
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	_, err := s.Client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.Bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.Bucket, Object: src},
+	)
+	if err != nil {
+		return convertS3Error(err)
+	}
+	return s.Delete(ctx, src)
+}
+
+// Delete removes the object
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return convertS3Error(s.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{}))
+}
+
+// List reports every object whose key starts with prefix
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Stops the listing goroutine if fn returns early
+
+	for obj := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return convertS3Error(obj.Err)
+		}
+		if err := fn(ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertS3Error maps missing key errors to ErrNotFound
+func convertS3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the requested object does not exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is implemented by every storage driver. Keys are slash separated
+// paths relative to the root of the backend (e.g. "username/report.pdf").
+type Backend interface {
+	// Put streams r into the object stored at key, replacing any existing
+	// object. size is the number of bytes in r, or -1 if unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Get opens the object stored at key for reading. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+
+	// Stat returns metadata for the object stored at key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+
+	// Move renames the object stored at src to dst, replacing any existing object at dst
+	Move(ctx context.Context, src, dst string) error
+
+	// Delete removes the object stored at key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List calls fn for every object whose key starts with prefix, stopping
+	// at the first error returned by fn.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// NewFromEnv creates the backend selected by the STORAGE_TYPE environment variable
+func NewFromEnv() (Backend, error) {
+	storageType := strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE_TYPE")))
+
+	switch storageType {
+	case "", "local":
+		dataPath := os.Getenv("DATA_PATH")
+		if dataPath == "" {
+			dataPath = "/app/data" // Default path used by the Docker image
+		}
+		return NewLocal(filepath.Join(dataPath, "uploads"))
+	case "minio", "s3":
+		return NewS3(S3Config{
+			Endpoint:  getenv("MINIO_ENDPOINT", joinHostPort(os.Getenv("MINIO_HOST"), os.Getenv("MINIO_PORT"))),
+			AccessKey: getenv("MINIO_ACCESS_KEY", os.Getenv("MINIO_ROOT_USER")),
+			SecretKey: getenv("MINIO_SECRET_KEY", os.Getenv("MINIO_ROOT_PASSWD")),
+			Bucket:    getenv("MINIO_BUCKET_NAME", getenv("MINIO_BUCKET", "defdrive")),
+			Region:    os.Getenv("MINIO_REGION"),
+			UseSSL:    strings.EqualFold(os.Getenv("MINIO_USE_SSL"), "true"),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported STORAGE_TYPE %q (expected local or minio)", storageType)
+	}
+}
+
+// getenv returns the value of the environment variable key or fallback if it is empty
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func joinHostPort(host, port string) string {
+	if host == "" {
+		return ""
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
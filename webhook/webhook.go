@@ -0,0 +1,372 @@
+// Package webhook queues events for the webhooks users have registered and
+// delivers them as signed HTTP POST requests, retrying failed deliveries
+// with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"defdrive/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-DefDrive-Event"
+	DeliveryHeader  = "X-DefDrive-Delivery"
+	SignatureHeader = "X-DefDrive-Signature"
+)
+
+const (
+	batchSize         = 20
+	maxResponseBody   = 1024
+	maxRetryDelay     = 6 * time.Hour
+	pruneInterval     = time.Hour
+	defaultRetention  = 30 * 24 * time.Hour
+	defaultRetryBase  = 30 * time.Second
+	defaultTimeout    = 10 * time.Second
+	defaultPoll       = 5 * time.Second
+	defaultMaxAttempt = 8
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	ID        string      `json:"id"` // Unique per event, shared by the deliveries to all subscribed webhooks
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher queues events in the database and delivers them in the
+// background. Deliveries survive restarts and can be processed by several
+// replicas, each claiming a delivery before attempting it.
+type Dispatcher struct {
+	DB          *gorm.DB
+	Client      *http.Client
+	MaxAttempts int           // Attempts before a delivery is marked as failed
+	RetryBase   time.Duration // Delay after the first failed attempt, doubled with every further one
+	Interval    time.Duration // How often the queue is polled for due deliveries
+	Retention   time.Duration // How long finished deliveries are kept in the log
+
+	wake chan struct{}
+}
+
+// NewFromEnv creates a dispatcher configured by the WEBHOOK_* environment
+// variables. Private networks are blocked unless WEBHOOK_ALLOW_PRIVATE_NETWORKS=true.
+func NewFromEnv(db *gorm.DB) *Dispatcher {
+	timeout := getDuration("WEBHOOK_TIMEOUT", defaultTimeout)
+	return &Dispatcher{
+		DB:          db,
+		Client:      NewClient(timeout, os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") != "true"),
+		MaxAttempts: getInt("WEBHOOK_MAX_ATTEMPTS", defaultMaxAttempt),
+		RetryBase:   getDuration("WEBHOOK_RETRY_BASE", defaultRetryBase),
+		Interval:    getDuration("WEBHOOK_POLL_INTERVAL", defaultPoll),
+		Retention:   getDuration("WEBHOOK_DELIVERY_RETENTION", defaultRetention),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// NewClient returns the HTTP client used for deliveries. Redirects are not
+// followed. With blockPrivate, connections to loopback, private, shared
+// (carrier-grade NAT) and link-local addresses are refused, so webhooks cannot reach internal services.
+func NewClient(timeout time.Duration, blockPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if blockPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook: connections to %s are not allowed", host)
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP.IsPrivate does not cover
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// Sign returns the signature of a delivery body sent at timestamp: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook's secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Enqueue queues event for every active webhook of userID subscribed to it.
+// Errors are logged, since events must never fail the request that caused them.
+func (d *Dispatcher) Enqueue(userID uint, event string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	var hooks []models.Webhook
+	if err := d.DB.Where("user_id = ? AND active = ?", userID, true).Find(&hooks).Error; err != nil {
+		log.Printf("Failed to look up webhooks for user %d: %v", userID, err)
+		return
+	}
+
+	var subscribed []models.Webhook
+	for _, hook := range hooks {
+		if hook.Subscribed(event) {
+			subscribed = append(subscribed, hook)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+
+	if _, err := d.queue(subscribed, event, data); err != nil {
+		log.Printf("Failed to queue %s webhook deliveries for user %d: %v", event, userID, err)
+	}
+}
+
+// Ping queues a test event for a webhook, whatever events it is subscribed to
+func (d *Dispatcher) Ping(hook models.Webhook) (models.WebhookDelivery, error) {
+	deliveries, err := d.queue([]models.Webhook{hook}, models.EventPing, map[string]interface{}{"webhook_id": hook.ID})
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	return deliveries[0], nil
+}
+
+// Redeliver queues a finished delivery to be attempted again
+func (d *Dispatcher) Redeliver(delivery *models.WebhookDelivery) error {
+	delivery.Status = models.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	if err := d.DB.Model(delivery).Select("Status", "Attempts", "NextAttemptAt").Updates(delivery).Error; err != nil {
+		return err
+	}
+	d.notify()
+	return nil
+}
+
+func (d *Dispatcher) queue(hooks []models.Webhook, event string, data interface{}) ([]models.WebhookDelivery, error) {
+	now := time.Now()
+	body, err := json.Marshal(Payload{ID: uuid.NewString(), Event: event, CreatedAt: now.UTC(), Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]models.WebhookDelivery, 0, len(hooks))
+	for _, hook := range hooks {
+		deliveries = append(deliveries, models.WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         event,
+			Payload:       string(body),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: now,
+		})
+	}
+	if err := d.DB.Create(&deliveries).Error; err != nil {
+		return nil, err
+	}
+
+	d.notify()
+	return deliveries, nil
+}
+
+// notify wakes up the delivery loop without waiting for the next poll
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued events until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	log.Printf("Webhook dispatcher started (max attempts %d, retry base %s)", d.MaxAttempts, d.RetryBase)
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	var lastPrune time.Time
+	for {
+		d.DeliverDue(ctx)
+
+		if time.Since(lastPrune) >= pruneInterval {
+			d.prune()
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// DeliverDue attempts every delivery whose next attempt is due
+func (d *Dispatcher) DeliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		now := time.Now()
+		var due []models.WebhookDelivery
+		if err := d.DB.Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, now).
+			Order("next_attempt_at").Limit(batchSize).Find(&due).Error; err != nil {
+			log.Printf("Failed to load webhook deliveries: %v", err)
+			return
+		}
+		if len(due) == 0 {
+			return
+		}
+
+		for _, delivery := range due {
+			if d.claim(delivery, now) {
+				d.attempt(ctx, delivery)
+			}
+		}
+	}
+}
+
+// claim reserves a delivery for this dispatcher by moving its next attempt
+// past the time the attempt can take, so other replicas skip it
+func (d *Dispatcher) claim(delivery models.WebhookDelivery, now time.Time) bool {
+	result := d.DB.Model(&models.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", delivery.ID, models.DeliveryPending, now).
+		Update("next_attempt_at", now.Add(2*d.Client.Timeout+time.Minute))
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// attempt sends a delivery once and records the outcome
+func (d *Dispatcher) attempt(ctx context.Context, delivery models.WebhookDelivery) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":        delivery.Attempts + 1,
+		"last_attempt_at": now,
+		"response_status": 0,
+		"response_body":   "",
+		"error":           "",
+	}
+
+	status, body, err := d.send(ctx, delivery)
+	switch {
+	case err == nil:
+		updates["status"] = models.DeliverySucceeded
+	case errors.Is(err, errWebhookGone) || delivery.Attempts+1 >= d.MaxAttempts:
+		updates["status"] = models.DeliveryFailed
+	default:
+		updates["next_attempt_at"] = now.Add(d.backoff(delivery.Attempts + 1))
+	}
+	if err != nil {
+		updates["error"] = err.Error()
+	}
+	updates["response_status"] = status
+	updates["response_body"] = body
+
+	if err := d.DB.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+var errWebhookGone = errors.New("webhook was deleted or disabled")
+
+// send POSTs the delivery's payload, returning the response status and the start of its body
+func (d *Dispatcher) send(ctx context.Context, delivery models.WebhookDelivery) (int, string, error) {
+	var hook models.Webhook
+	if err := d.DB.First(&hook, delivery.WebhookID).Error; err != nil || (!hook.Active && delivery.Event != models.EventPing) {
+		return 0, "", errWebhookGone
+	}
+
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DefDrive-Webhook/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(hook.Secret, timestamp, body)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(snippet), fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, string(snippet), nil
+}
+
+// backoff returns the delay before the attempt following the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.RetryBase
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// prune removes finished deliveries older than the retention period
+func (d *Dispatcher) prune() {
+	if err := d.DB.Where("status <> ? AND created_at < ?", models.DeliveryPending, time.Now().Add(-d.Retention)).
+		Delete(&models.WebhookDelivery{}).Error; err != nil {
+		log.Printf("Failed to prune webhook deliveries: %v", err)
+	}
+}
+
+func getInt(key string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func getDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}